@@ -2,83 +2,231 @@ package main
 
 import (
 	"context"
-	"io/fs"
+	"crypto/ecdsa"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
-	"github.com/klauspost/compress/gzhttp"
+	"github.com/modfin/epoxy/internal/certstore"
 	"github.com/modfin/epoxy/internal/cf"
 	"github.com/modfin/epoxy/internal/config"
 	"github.com/modfin/epoxy/internal/csp"
 	"github.com/modfin/epoxy/internal/dev"
 	"github.com/modfin/epoxy/internal/epoxytoken"
+	"github.com/modfin/epoxy/internal/errorpage"
 	"github.com/modfin/epoxy/internal/extjwt"
+	"github.com/modfin/epoxy/internal/forwardauth"
+	"github.com/modfin/epoxy/internal/gzip"
 	"github.com/modfin/epoxy/internal/log"
 	"github.com/modfin/epoxy/internal/nocache"
+	"github.com/modfin/epoxy/internal/oidc"
+	"github.com/modfin/epoxy/internal/sanitize"
+	"github.com/modfin/epoxy/internal/status"
 	"github.com/modfin/epoxy/pkg/epoxy"
+	"github.com/modfin/epoxy/pkg/jwk"
 )
 
 func main() {
 	cfg := config.Get()
-	var publicFs fs.FS
+	ctx, _ := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	var sites []epoxy.Site
 	if cfg.PublicDir != "" {
-		publicFs = os.DirFS(cfg.PublicDir)
+		sites = append(sites, epoxy.Site{Dir: os.DirFS(cfg.PublicDir), Prefix: cfg.PublicPrefix})
+	}
+	for _, p := range cfg.PublicHosts {
+		sites = append(sites, epoxy.Site{Host: p.Host, Dir: os.DirFS(p.Dir), Prefix: p.Prefix})
 	}
-	e, err := epoxy.New(publicFs, cfg.PublicPrefix, cfg.Routes...)
+	e, err := epoxy.NewWithSites(sites, cfg.Routes...)
 	if err != nil {
 		log.New().WithError(err).Fatal("failed to init epoxy")
 	}
 
+	var jwksKeys []*ecdsa.PublicKey
+	if cfg.JwtKeys != nil {
+		jwksKeys = cfg.JwtKeys.PublicKeys()
+	}
+
+	tokens := epoxytoken.Options{
+		Keys:   cfg.JwtKeys,
+		Issuer: cfg.JwtIssuer,
+		Ttl:    cfg.JwtTtl,
+		Audience: func(r *http.Request) string {
+			route, _ := epoxy.MatchRoute(e, r)
+			return route.TokenAudience
+		},
+		Claims:        cfg.JwtClaims,
+		OmitExtClaims: cfg.JwtOmitExtClaims,
+	}
+
 	var epoxies []epoxy.Epoxy
 
-	if cfg.CfAppAud != "" {
-		var gzipMiddleware = func(h http.Handler) http.Handler {
-			return gzhttp.GzipHandler(h)
-		}
+	var extJwtValidation []jwk.Option
+	if cfg.ExtJwtIssuer != "" {
+		extJwtValidation = append(extJwtValidation, jwk.WithIssuer(cfg.ExtJwtIssuer))
+	}
+	if len(cfg.ExtJwtAudiences) > 0 {
+		extJwtValidation = append(extJwtValidation, jwk.WithAudience(cfg.ExtJwtAudiences...))
+	}
+
+	if len(cfg.CfApps) > 0 {
 		middlewares := []epoxy.Middleware{
-			extjwt.Middleware(cfg.ExtJwkUrl, cfg.ExtJwtUrl),
-			cf.Middleware(cfg.CfAppAud, cfg.CfJwkUrl),
+			extjwt.Middleware(ctx, cfg.ExtJwkUrl, cfg.ExtJwtUrl, cfg.ExtJwtForServiceTokens, extJwtValidation...),
+			cf.Middleware(ctx, cfg.CfApps, cfg.CfTokenSources),
+			epoxytoken.JwksMiddleware(cfg.JwksPath, jwksKeys...),
 			nocache.Middleware,
-			gzipMiddleware,
+			gzip.Middleware,
+			sanitize.Middleware(cfg.StripHeaders),
+			errorpage.Middleware(cfg.ErrorPages),
 			log.Middleware,
 		}
-		if cfg.JwtEc256 != nil {
-			middlewares = append([]epoxy.Middleware{epoxytoken.MiddlewareExt(cfg.JwtEc256, cfg.ExtJwtSubjectPath)}, middlewares...)
+		if cfg.JwtKeys != nil {
+			middlewares = append([]epoxy.Middleware{epoxytoken.MiddlewareExt(tokens, cfg.ExtJwtSubjectPath)}, middlewares...)
 		}
 		if cfg.ContentSecurityPolicy != "" {
 			middlewares = append([]epoxy.Middleware{csp.Middleware(cfg.ContentSecurityPolicy)}, middlewares...)
 		}
-		epoxies = append(epoxies, e.WithMiddlewares(middlewares).Finalize("cf", cfg.CfAddr))
+		if cfg.UpstreamStatusPath != "" {
+			middlewares = append([]epoxy.Middleware{status.Middleware(cfg.UpstreamStatusPath, e)}, middlewares...)
+		}
+		epoxies = append(epoxies, withTLS(ctx, e.WithMiddlewares(middlewares).Finalize("cf", cfg.CfAddr), cfg.CfTlsCertFiles, cfg.CfTlsKeyFiles))
 	}
 
-	if cfg.DevBcryptHash != "" {
+	if cfg.FwdAuthAddr != "" {
+		middlewares := []epoxy.Middleware{forwardauth.Middleware(e)}
+		if cfg.JwtKeys != nil {
+			middlewares = append(middlewares, epoxytoken.MiddlewareExt(tokens, cfg.ExtJwtSubjectPath))
+		}
+		middlewares = append(middlewares,
+			extjwt.Middleware(ctx, cfg.ExtJwkUrl, cfg.ExtJwtUrl, cfg.ExtJwtForServiceTokens, extJwtValidation...),
+			cf.Middleware(ctx, cfg.CfApps, cfg.CfTokenSources),
+			forwardauth.Forwarded,
+			nocache.Middleware,
+			sanitize.Middleware(cfg.StripHeaders),
+			errorpage.Middleware(cfg.ErrorPages),
+			log.Middleware,
+		)
+		epoxies = append(epoxies, withTLS(ctx, e.WithMiddlewares(middlewares).Finalize("forward-auth", cfg.FwdAuthAddr), cfg.FwdAuthTlsCertFiles, cfg.FwdAuthTlsKeyFiles))
+	}
+
+	if cfg.DevBcryptHash != "" || cfg.DevUsers != nil {
+		if cfg.DevUsers != nil {
+			go cfg.DevUsers.Watch(ctx, 10*time.Second)
+		}
+		go cfg.DevSessions.Watch(ctx, 10*time.Second)
+		var middlewares []epoxy.Middleware
+		var cfJwksPath string
+		var cfJwksKeys []*ecdsa.PublicKey
+		if emulation := cfg.DevCfEmulation; emulation != nil {
+			app, err := emulation.App()
+			if err != nil {
+				log.New().WithError(err).Fatal("failed to init cf emulation")
+			}
+			middlewares = append(middlewares,
+				epoxytoken.MiddlewareExt(tokens, cfg.ExtJwtSubjectPath),
+				extjwt.Middleware(ctx, cfg.ExtJwkUrl, cfg.ExtJwtUrl, cfg.ExtJwtForServiceTokens, extJwtValidation...),
+				cf.Middleware(ctx, []cf.App{app}, []string{cf.SourceHeader}),
+				emulation.Middleware,
+			)
+			cfJwksPath, cfJwksKeys = dev.CfJwksPath, emulation.PublicKeys()
+		} else {
+			middlewares = append(middlewares, epoxytoken.MiddlewareDev(tokens, cfg.DevAllowedUserSuffix))
+		}
+		middlewares = append(middlewares,
+			dev.Middleware(dev.Options{
+				BcryptHash:          cfg.DevBcryptHash,
+				Users:               cfg.DevUsers,
+				SessionDuration:     cfg.DevSessionDuration,
+				SlidingSession:      cfg.DevSlidingSession,
+				Sessions:            cfg.DevSessions,
+				LogoutPath:          cfg.DevLogoutPath,
+				LoginPath:           cfg.DevLoginPath,
+				LoginPage:           cfg.DevLoginPage,
+				SessionsPath:        cfg.DevSessionsPath,
+				SessionAdmins:       cfg.DevSessionAdmins,
+				MaxLoginAttempts:    cfg.DevLoginMaxAttempts,
+				LoginLockout:        cfg.DevLoginLockout,
+				Keys:                cfg.JwtKeys,
+				DisableSecureCookie: cfg.DevDisableSecureCookie,
+			}),
+			epoxytoken.JwksMiddleware(cfg.JwksPath, jwksKeys...),
+			epoxytoken.JwksMiddleware(cfJwksPath, cfJwksKeys...),
+			nocache.Middleware,
+			sanitize.Middleware(cfg.StripHeaders),
+			errorpage.Middleware(cfg.ErrorPages),
+			log.Middleware,
+		)
+		if cfg.ContentSecurityPolicy != "" {
+			middlewares = append([]epoxy.Middleware{csp.Middleware(cfg.ContentSecurityPolicy)}, middlewares...)
+		}
+		if cfg.UpstreamStatusPath != "" {
+			middlewares = append([]epoxy.Middleware{status.Middleware(cfg.UpstreamStatusPath, e)}, middlewares...)
+		}
+		epoxies = append(epoxies, withTLS(ctx, e.WithMiddlewares(middlewares).Finalize("dev", cfg.DevAddr), cfg.DevTlsCertFiles, cfg.DevTlsKeyFiles))
+	}
+
+	if cfg.OidcIssuer != "" {
 		middlewares := []epoxy.Middleware{
-			epoxytoken.MiddlewareDev(cfg.JwtEc256, cfg.DevAllowedUserSuffix),
-			dev.Middleware(cfg.DevBcryptHash, cfg.DevSessionDuration, cfg.JwtEc256, cfg.JwtEc256Pub, cfg.DevDisableSecureCookie),
+			oidc.Middleware(ctx, oidc.Options{
+				Issuer:          cfg.OidcIssuer,
+				ClientId:        cfg.OidcClientId,
+				ClientSecret:    cfg.OidcClientSecret,
+				RedirectUrl:     cfg.OidcRedirectUrl,
+				Scopes:          cfg.OidcScopes,
+				SessionKey:      cfg.OidcSessionKey,
+				SessionDuration: cfg.OidcSessionDuration,
+				LogoutPath:      cfg.OidcLogoutPath,
+				PostLogoutUrl:   cfg.OidcPostLogoutUrl,
+			}),
+			epoxytoken.JwksMiddleware(cfg.JwksPath, jwksKeys...),
 			nocache.Middleware,
+			sanitize.Middleware(cfg.StripHeaders),
+			errorpage.Middleware(cfg.ErrorPages),
 			log.Middleware,
 		}
+		if cfg.JwtKeys != nil {
+			middlewares = append([]epoxy.Middleware{epoxytoken.MiddlewareOidc(tokens, cfg.OidcSubjectPath)}, middlewares...)
+		}
 		if cfg.ContentSecurityPolicy != "" {
 			middlewares = append([]epoxy.Middleware{csp.Middleware(cfg.ContentSecurityPolicy)}, middlewares...)
 		}
-		epoxies = append(epoxies, e.WithMiddlewares(middlewares).Finalize("dev", cfg.DevAddr))
+		if cfg.UpstreamStatusPath != "" {
+			middlewares = append([]epoxy.Middleware{status.Middleware(cfg.UpstreamStatusPath, e)}, middlewares...)
+		}
+		epoxies = append(epoxies, withTLS(ctx, e.WithMiddlewares(middlewares).Finalize("oidc", cfg.OidcAddr), cfg.OidcTlsCertFiles, cfg.OidcTlsKeyFiles))
 	}
 
 	if cfg.NoAuthEnable && cfg.NoAuthAddr != "" {
 		middlewares := []epoxy.Middleware{
+			epoxytoken.JwksMiddleware(cfg.JwksPath, jwksKeys...),
 			nocache.Middleware,
+			sanitize.Middleware(cfg.StripHeaders),
+			errorpage.Middleware(cfg.ErrorPages),
 			log.Middleware,
 		}
 		if cfg.ContentSecurityPolicy != "" {
 			middlewares = append([]epoxy.Middleware{csp.Middleware(cfg.ContentSecurityPolicy)}, middlewares...)
 		}
-		epoxies = append(epoxies, e.WithMiddlewares(middlewares).Finalize("no-auth", cfg.NoAuthAddr))
+		if cfg.UpstreamStatusPath != "" {
+			middlewares = append([]epoxy.Middleware{status.Middleware(cfg.UpstreamStatusPath, e)}, middlewares...)
+		}
+		epoxies = append(epoxies, withTLS(ctx, e.WithMiddlewares(middlewares).Finalize("no-auth", cfg.NoAuthAddr), cfg.NoAuthTlsCertFiles, cfg.NoAuthTlsKeyFiles))
 	}
 
-	ctx, _ := signal.NotifyContext(context.Background(), syscall.SIGTERM)
 	err = epoxy.Serve(ctx, epoxies...)
 	log.New().WithError(err).Info("shutting down")
 	log.Drain(context.Background())
 }
+
+func withTLS(ctx context.Context, e epoxy.Epoxy, certFiles []string, keyFiles []string) epoxy.Epoxy {
+	if len(certFiles) == 0 && len(keyFiles) == 0 {
+		return e
+	}
+	store, err := certstore.New(certFiles, keyFiles)
+	if err != nil {
+		log.New().WithError(err).Fatal("failed to load tls certificates")
+	}
+	go store.Watch(ctx, 10*time.Second)
+	return e.WithTLS(store.TLSConfig())
+}
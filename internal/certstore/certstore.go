@@ -0,0 +1,84 @@
+package certstore
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/modfin/epoxy/internal/filewatch"
+	"github.com/modfin/epoxy/internal/log"
+)
+
+// Store holds certificates loaded from PEM files, selected by SNI and reloaded when the files change.
+type Store struct {
+	certFiles []string
+	keyFiles  []string
+	mu        sync.RWMutex
+	certs     []tls.Certificate
+}
+
+func New(certFiles []string, keyFiles []string) (*Store, error) {
+	if len(certFiles) == 0 || len(certFiles) != len(keyFiles) {
+		return nil, errors.New("certstore: one key file per certificate file required")
+	}
+	s := &Store{
+		certFiles: certFiles,
+		keyFiles:  keyFiles,
+	}
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) load() error {
+	var certs []tls.Certificate
+	for i := range s.certFiles {
+		cert, err := tls.LoadX509KeyPair(s.certFiles[i], s.keyFiles[i])
+		if err != nil {
+			return fmt.Errorf("certstore: error loading %s: %w", s.certFiles[i], err)
+		}
+		certs = append(certs, cert)
+	}
+	s.mu.Lock()
+	s.certs = certs
+	s.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the certificates when the files change, until ctx is done.
+// On error the previously loaded certificates are kept.
+func (s *Store) Watch(ctx context.Context, interval time.Duration) {
+	files := append(append([]string{}, s.certFiles...), s.keyFiles...)
+	filewatch.Watch(ctx, interval, files, func() {
+		err := s.load()
+		if err != nil {
+			log.New().WithError(err).Error("certstore: error reloading certificates, keeping previous")
+			return
+		}
+		log.New().WithField("certificates", s.certFiles).Info("certstore: reloaded certificates")
+	})
+}
+
+// GetCertificate selects the first certificate valid for the SNI of hello, or the first certificate if none is.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := range s.certs {
+		if hello.SupportsCertificate(&s.certs[i]) == nil {
+			return &s.certs[i], nil
+		}
+	}
+	return &s.certs[0], nil
+}
+
+func (s *Store) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.GetCertificate,
+	}
+}
@@ -0,0 +1,84 @@
+package cf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/modfin/epoxy/pkg/jwk"
+)
+
+// App is a Cloudflare Access application, whose tokens are accepted for requests matching Hosts and Prefixes.
+// An app without hosts or prefixes accepts requests for any host or path.
+type App struct {
+	Name     string   `json:"name"`
+	Issuer   string   `json:"issuer,omitempty"`   // e.g. https://<your-team-name>.cloudflareaccess.com, checked if set
+	JwksUrl  string   `json:"jwks_url,omitempty"` // defaults to <issuer>/cdn-cgi/access/certs
+	Aud      string   `json:"aud"`
+	Hosts    []string `json:"hosts,omitempty"`    // exact or wildcard e.g. *.example.com
+	Prefixes []string `json:"prefixes,omitempty"` // path prefixes
+
+	Keys *jwk.Provider `json:"-"` // verifies tokens instead of the key set of JwksUrl, e.g. when emulated in dev mode
+}
+
+type app struct {
+	App
+	keys       *jwk.Provider
+	validation []jwk.Option
+}
+
+func newApp(ctx context.Context, a App) (*app, error) {
+	if a.JwksUrl == "" && a.Issuer != "" {
+		a.JwksUrl = strings.TrimSuffix(a.Issuer, "/") + "/cdn-cgi/access/certs"
+	}
+	if a.Aud == "" || (a.JwksUrl == "" && a.Keys == nil) {
+		return nil, errors.New("aud and jwks_url or issuer required")
+	}
+	if a.Name == "" {
+		a.Name = a.Aud
+	}
+	validation := []jwk.Option{jwk.WithAudience(a.Aud), jwk.WithRequiredClaims("exp")}
+	if a.Issuer != "" {
+		validation = append(validation, jwk.WithIssuer(a.Issuer))
+	}
+	keys := a.Keys
+	if keys == nil {
+		keys = jwk.NewProvider(ctx, a.JwksUrl)
+	}
+	return &app{App: a, keys: keys, validation: validation}, nil
+}
+
+// matches reports if the app is bound to the host and path of r, and issued the unverified token claims.
+func (a *app) matches(r *http.Request, unverified jwt.RegisteredClaims) bool {
+	if len(a.Hosts) > 0 && !slices.ContainsFunc(a.Hosts, func(h string) bool { return hostMatches(h, r.Host) }) {
+		return false
+	}
+	if len(a.Prefixes) > 0 && !slices.ContainsFunc(a.Prefixes, func(p string) bool { return pathMatches(p, r.URL.Path) }) {
+		return false
+	}
+	if a.Issuer != "" && strings.TrimSuffix(unverified.Issuer, "/") != strings.TrimSuffix(a.Issuer, "/") {
+		return false
+	}
+	return slices.Contains(unverified.Audience, a.Aud)
+}
+
+func hostMatches(pattern string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+func pathMatches(prefix string, path string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
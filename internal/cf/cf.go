@@ -5,50 +5,123 @@ import (
 	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/modfin/epoxy/internal/errorpage"
 	"github.com/modfin/epoxy/internal/log"
-	"github.com/modfin/epoxy/internal/simplecache"
 	"github.com/modfin/epoxy/pkg/epoxy"
-	"github.com/modfin/epoxy/pkg/jwk"
 	"net/http"
-	"time"
+	"strings"
 )
 
 type contextKey struct{}
 
-func Middleware(cfAppAud string, cfJwksUrl string) epoxy.Middleware {
-	if cfAppAud == "" || cfJwksUrl == "" {
-		log.New().Fatal("cf: CF_APP_AUD and CF_JWKS_URL required")
+const (
+	SourceHeader = "header" // Cf-Access-Jwt-Assertion header
+	SourceCookie = "cookie" // CF_Authorization cookie
+	SourceBearer = "bearer" // Authorization: Bearer header
+)
+
+// Middleware validates the Cloudflare Access token, read from the first of tokenSources present in the request,
+// against the apps matching the request. The key sets of the apps are kept refreshed until ctx is done.
+func Middleware(ctx context.Context, apps []App, tokenSources []string) epoxy.Middleware {
+	if len(apps) == 0 {
+		log.New().Fatal("cf: CF_APP_AUD and CF_JWKS_URL or CF_APPS required")
+	}
+	var cfApps []*app
+	for _, a := range apps {
+		cfApp, err := newApp(ctx, a)
+		if err != nil {
+			log.New().WithError(err).Fatal(fmt.Sprintf("cf: invalid app '%s'", a.Name))
+		}
+		cfApps = append(cfApps, cfApp)
+	}
+	if len(tokenSources) == 0 {
+		log.New().Fatal("cf: at least one token source required")
+	}
+	for _, s := range tokenSources {
+		if s != SourceHeader && s != SourceCookie && s != SourceBearer {
+			log.New().Fatal(fmt.Sprintf("cf: unknown token source '%s'", s))
+		}
 	}
 	return func(next http.Handler) http.Handler {
-
-		jwkCache := simplecache.New(time.Minute * 30)
-
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			source, rawToken := tokenFromRequest(r, tokenSources)
+			log.New().WithField("cf_token_source", source).AddToContext(r.Context())
+
+			// claims are trusted only after the token is verified with the key set of the matching app
 			var claims Claims
-			token, err := jwk.ParseWithUrlIntoClaims(r.Context(), jwkCache, cfJwksUrl, r.Header.Get("Cf-Access-Jwt-Assertion"), &claims)
+			_, _, err := jwt.NewParser().ParseUnverified(rawToken, &claims)
 			if err != nil {
 				log.New().WithError(fmt.Errorf("cf: error parsing jwt token: %w", err)).AddToContext(r.Context())
-				w.WriteHeader(http.StatusUnauthorized)
+				errorpage.Write(w, r, http.StatusUnauthorized)
 				return
 			}
-			foundAppAud := false
-			for _, aud := range claims.Audience {
-				if aud == cfAppAud {
-					foundAppAud = true
+			var cfApp *app
+			for _, a := range cfApps {
+				if a.matches(r, claims.RegisteredClaims) {
+					cfApp = a
+					break
 				}
 			}
-			if !foundAppAud {
-				log.New().WithError(errors.New("cf: aud not matching CF_APP_AUD")).AddToContext(r.Context())
-				w.WriteHeader(http.StatusUnauthorized)
+			if cfApp == nil {
+				log.New().WithError(errors.New("cf: no app matching token aud, issuer and request")).AddToContext(r.Context())
+				errorpage.Write(w, r, http.StatusUnauthorized)
 				return
 			}
-			log.New().WithField("email", claims.Email).AddToContext(r.Context())
+			log.New().WithField("cf_app", cfApp.Name).AddToContext(r.Context())
+
+			token, err := cfApp.keys.Parse(rawToken, nil, cfApp.validation...)
+			if err != nil {
+				log.New().WithError(fmt.Errorf("cf: error parsing jwt token: %w", err)).AddToContext(r.Context())
+				errorpage.Write(w, r, http.StatusUnauthorized)
+				return
+			}
+			mapClaims, _ := token.Claims.(jwt.MapClaims)
+			id := &epoxy.Identity{
+				Type:    epoxy.IdentityUser,
+				Email:   claims.Email,
+				Country: claims.Country,
+				Claims:  mapClaims,
+			}
+			if claims.IsServiceToken() {
+				id.Type = epoxy.IdentityService
+				id.CommonName = claims.CommonName
+				log.New().WithField("cf_service_token", claims.CommonName).AddToContext(r.Context())
+			} else {
+				log.New().WithField("email", claims.Email).AddToContext(r.Context())
+			}
+			if claims.Email != "" {
+				r.Header.Set("Cf-Access-Authenticated-User-Email", claims.Email)
+			}
 			ctx := context.WithValue(r.Context(), contextKey{}, token)
+			ctx = epoxy.WithIdentity(ctx, id)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
+// tokenFromRequest returns the first token found in the request, in order of sources, and the source it was found in.
+func tokenFromRequest(r *http.Request, sources []string) (string, string) {
+	for _, s := range sources {
+		var token string
+		switch s {
+		case SourceHeader:
+			token = r.Header.Get("Cf-Access-Jwt-Assertion")
+		case SourceCookie:
+			if c, err := r.Cookie("CF_Authorization"); err == nil {
+				token = c.Value
+			}
+		case SourceBearer:
+			if scheme, t, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "bearer") {
+				token = strings.TrimSpace(t)
+			}
+		}
+		if token != "" {
+			return s, token
+		}
+	}
+	return "", ""
+}
+
 func AccessToken(ctx context.Context) (*jwt.Token, error) {
 	if t, ok := ctx.Value(contextKey{}).(*jwt.Token); ok {
 		return t, nil
@@ -62,4 +135,10 @@ type Claims struct {
 	Type          string `json:"type"`
 	IdentityNonce string `json:"identity_nonce"`
 	Country       string `json:"country"`
+	CommonName    string `json:"common_name"` // client id of a service token
+}
+
+// IsServiceToken reports if the claims identify a machine client authenticated with a service token, rather than a user.
+func (c Claims) IsServiceToken() bool {
+	return c.Email == "" && c.CommonName != ""
 }
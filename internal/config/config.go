@@ -2,14 +2,21 @@ package config
 
 import (
 	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"html/template"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/caarlos0/env/v11"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/modfin/epoxy/internal/cf"
+	"github.com/modfin/epoxy/internal/dev"
+	"github.com/modfin/epoxy/internal/errorpage"
+	"github.com/modfin/epoxy/internal/keyset"
 	"github.com/modfin/epoxy/internal/log"
 	"github.com/modfin/epoxy/pkg/epoxy"
 )
@@ -22,28 +29,91 @@ type config struct {
 
 	PublicDir    string `env:"PUBLIC_DIR"`
 	PublicPrefix string `env:"PUBLIC_PREFIX"`
+	PublicHosts  string `env:"PUBLIC_HOSTS"`
 
 	CfAddr    string `env:"CF_ADDR" envDefault:"127.0.0.1:8080"`
 	CfJwksUrl string `env:"CF_JWKS_URL"`
 	CfAppAud  string `env:"CF_APP_AUD"`
 
+	CfTokenSources []string `env:"CF_TOKEN_SOURCES" envDefault:"header,cookie"`
+	CfApps         string   `env:"CF_APPS"`
+
+	CfTlsCertFiles []string `env:"CF_TLS_CERT_FILES"`
+	CfTlsKeyFiles  []string `env:"CF_TLS_KEY_FILES"`
+
 	DevAddr                string        `env:"DEV_ADDR" envDefault:":7070"`
 	DevAllowedUserSuffix   string        `env:"DEV_ALLOWED_USER_SUFFIX"`
 	DevBcryptHash          string        `env:"DEV_BCRYPT_HASH"`
 	DevSessionDuration     time.Duration `env:"DEV_SESSION_DURATION"`
 	DevDisableSecureCookie bool          `env:"DEV_DISABLE_SECURE_COOKIE"`
+	DevUsersFile           string        `env:"DEV_USERS_FILE"`
+	DevSlidingSession      bool          `env:"DEV_SLIDING_SESSION"`
+	DevSessionsFile        string        `env:"DEV_SESSIONS_FILE"`
+	DevLogoutPath          string        `env:"DEV_LOGOUT_PATH" envDefault:"/dev/logout"`
+	DevLoginPath           string        `env:"DEV_LOGIN_PATH" envDefault:"/dev/login"`
+	DevLoginPageFile       string        `env:"DEV_LOGIN_PAGE_FILE"`
+	DevSessionsPath        string        `env:"DEV_SESSIONS_PATH"`
+	DevSessionAdmins       []string      `env:"DEV_SESSION_ADMINS"`
+	DevLoginMaxAttempts    int           `env:"DEV_LOGIN_MAX_ATTEMPTS" envDefault:"10"`
+	DevLoginLockout        time.Duration `env:"DEV_LOGIN_LOCKOUT" envDefault:"15m"`
+	DevCfEmulation         bool          `env:"DEV_CF_EMULATION"`
+	DevCfAud               string        `env:"DEV_CF_AUD" envDefault:"epoxy-dev"`
+	DevCfIssuer            string        `env:"DEV_CF_ISSUER"`
+	DevTlsCertFiles        []string      `env:"DEV_TLS_CERT_FILES"`
+	DevTlsKeyFiles         []string      `env:"DEV_TLS_KEY_FILES"`
 
 	ExtJwksUrl        string `env:"EXT_JWKS_URL"`
 	ExtJwtUrl         string `env:"EXT_JWT_URL"`
 	ExtJwtSubjectPath string `env:"EXT_JWT_SUBJECT_PATH"`
 
+	ExtJwtForServiceTokens bool `env:"EXT_JWT_FETCH_FOR_SERVICE_TOKENS"`
+
+	ExtJwtIssuer    string   `env:"EXT_JWT_ISSUER"`
+	ExtJwtAudiences []string `env:"EXT_JWT_AUDIENCE"`
+
+	OidcAddr            string        `env:"OIDC_ADDR" envDefault:":6060"`
+	OidcIssuer          string        `env:"OIDC_ISSUER"`
+	OidcClientId        string        `env:"OIDC_CLIENT_ID"`
+	OidcClientSecret    string        `env:"OIDC_CLIENT_SECRET"`
+	OidcRedirectUrl     string        `env:"OIDC_REDIRECT_URL"`
+	OidcScopes          []string      `env:"OIDC_SCOPES" envDefault:"openid,email,profile"`
+	OidcSessionKey      string        `env:"OIDC_SESSION_KEY"`
+	OidcSessionDuration time.Duration `env:"OIDC_SESSION_DURATION" envDefault:"12h"`
+	OidcSubjectPath     string        `env:"OIDC_SUBJECT_PATH" envDefault:"email"`
+	OidcLogoutPath      string        `env:"OIDC_LOGOUT_PATH" envDefault:"/oidc/logout"`
+	OidcPostLogoutUrl   string        `env:"OIDC_POST_LOGOUT_URL"`
+	OidcTlsCertFiles    []string      `env:"OIDC_TLS_CERT_FILES"`
+	OidcTlsKeyFiles     []string      `env:"OIDC_TLS_KEY_FILES"`
+
+	FwdAuthAddr         string   `env:"FORWARD_AUTH_ADDR"`
+	FwdAuthTlsCertFiles []string `env:"FORWARD_AUTH_TLS_CERT_FILES"`
+	FwdAuthTlsKeyFiles  []string `env:"FORWARD_AUTH_TLS_KEY_FILES"`
+
 	NoAuthEnable bool   `env:"NO_AUTH_ENABLE"`
 	NoAuthAddr   string `env:"NO_AUTH_ADDR"`
 
-	JwtEc256    string `env:"JWT_EC_256"`
-	JwtEc256Pub string `env:"JWT_EC_256_PUB"`
+	NoAuthTlsCertFiles []string `env:"NO_AUTH_TLS_CERT_FILES"`
+	NoAuthTlsKeyFiles  []string `env:"NO_AUTH_TLS_KEY_FILES"`
+
+	JwtEc256       string `env:"JWT_EC_256"`
+	JwtEc256Pub    string `env:"JWT_EC_256_PUB"`
+	JwtEc256Verify string `env:"JWT_EC_256_VERIFY"`
+	JwtKeysDir     string `env:"JWT_KEYS_DIR"`
+	JwtActiveKey   string `env:"JWT_ACTIVE_KEY"`
+	JwksPath       string `env:"JWKS_PATH"`
+
+	JwtIssuer        string            `env:"JWT_ISSUER" envDefault:"epoxy"`
+	JwtTtl           time.Duration     `env:"JWT_TTL" envDefault:"1m"`
+	JwtClaims        map[string]string `env:"JWT_CLAIMS" envKeyValSeparator:"="`
+	JwtOmitExtClaims bool              `env:"JWT_OMIT_EXT_CLAIMS"`
 
 	ContentSecurityPolicy string `env:"CONTENT_SECURITY_POLICY"`
+
+	UpstreamStatusPath string `env:"UPSTREAM_STATUS_PATH"`
+
+	ErrorPagesDir string `env:"ERROR_PAGES_DIR"`
+
+	StripHeaders []string `env:"STRIP_HEADERS" envDefault:"Epoxy-Token,Cf-Access-Authenticated-User-Email"`
 }
 
 func Get() Config {
@@ -62,6 +132,53 @@ func Get() Config {
 			}
 		}
 
+		var publicHosts []PublicHost
+		if strings.TrimSpace(c.PublicHosts) != "" {
+			var err error
+			publicHosts, err = parsePublicHosts(c.PublicHosts)
+			if err != nil {
+				log.New().WithError(err).Fatal("error parsing PUBLIC_HOSTS")
+			}
+		}
+
+		var cfApps []cf.App
+		if strings.TrimSpace(c.CfAppAud) != "" {
+			cfApps = append(cfApps, cf.App{
+				Name:    "default",
+				JwksUrl: strings.TrimSpace(c.CfJwksUrl),
+				Aud:     strings.TrimSpace(c.CfAppAud),
+			})
+		}
+		if strings.TrimSpace(c.CfApps) != "" {
+			var apps []cf.App
+			err := json.Unmarshal([]byte(c.CfApps), &apps)
+			if err != nil {
+				log.New().WithError(err).Fatal("error parsing CF_APPS")
+			}
+			cfApps = append(cfApps, apps...)
+		}
+
+		var oidcSessionKey []byte
+		if strings.TrimSpace(c.OidcSessionKey) != "" {
+			var err error
+			oidcSessionKey, err = base64.StdEncoding.DecodeString(strings.TrimSpace(c.OidcSessionKey))
+			if err != nil || len(oidcSessionKey) != 32 {
+				log.New().WithError(err).Fatal("error: OIDC_SESSION_KEY must be 32 bytes, base64 encoded")
+			}
+		} else if strings.TrimSpace(c.OidcIssuer) != "" {
+			log.New().Info("OIDC_SESSION_KEY not set, using a random key, sessions will not survive a restart")
+			oidcSessionKey = make([]byte, 32)
+			_, _ = rand.Read(oidcSessionKey)
+		}
+
+		if c.JwtTtl <= 0 {
+			log.New().Fatal("error: JWT_TTL must be positive")
+		}
+		jwtClaims := make(map[string]string)
+		for name, path := range c.JwtClaims {
+			jwtClaims[strings.TrimSpace(name)] = strings.TrimSpace(path)
+		}
+
 		if c.DevSessionDuration.Milliseconds() < 0 {
 			log.New().Fatal("error: DEV_SESSION_DURATION is negative")
 		}
@@ -70,36 +187,135 @@ func Get() Config {
 			Routes:                 routes,
 			PublicDir:              strings.TrimSpace(c.PublicDir),
 			PublicPrefix:           strings.TrimSpace(c.PublicPrefix),
+			PublicHosts:            publicHosts,
 			CfAddr:                 strings.TrimSpace(c.CfAddr),
-			CfJwkUrl:               strings.TrimSpace(c.CfJwksUrl),
-			CfAppAud:               strings.TrimSpace(c.CfAppAud),
+			CfApps:                 cfApps,
+			CfTokenSources:         lowerAll(c.CfTokenSources),
+			CfTlsCertFiles:         trimAll(c.CfTlsCertFiles),
+			CfTlsKeyFiles:          trimAll(c.CfTlsKeyFiles),
 			ExtJwkUrl:              strings.TrimSpace(c.ExtJwksUrl),
 			ExtJwtUrl:              strings.TrimSpace(c.ExtJwtUrl),
 			ExtJwtSubjectPath:      strings.TrimSpace(c.ExtJwtSubjectPath),
+			ExtJwtForServiceTokens: c.ExtJwtForServiceTokens,
+			ExtJwtIssuer:           strings.TrimSpace(c.ExtJwtIssuer),
+			ExtJwtAudiences:        trimAll(c.ExtJwtAudiences),
 			DevAddr:                strings.TrimSpace(c.DevAddr),
 			DevBcryptHash:          strings.TrimSpace(c.DevBcryptHash),
 			DevAllowedUserSuffix:   strings.TrimSpace(c.DevAllowedUserSuffix),
+			OidcAddr:               strings.TrimSpace(c.OidcAddr),
+			OidcIssuer:             strings.TrimSpace(c.OidcIssuer),
+			OidcClientId:           strings.TrimSpace(c.OidcClientId),
+			OidcClientSecret:       strings.TrimSpace(c.OidcClientSecret),
+			OidcRedirectUrl:        strings.TrimSpace(c.OidcRedirectUrl),
+			OidcScopes:             trimAll(c.OidcScopes),
+			OidcSessionKey:         oidcSessionKey,
+			OidcSessionDuration:    c.OidcSessionDuration,
+			OidcSubjectPath:        strings.TrimSpace(c.OidcSubjectPath),
+			OidcLogoutPath:         strings.TrimSpace(c.OidcLogoutPath),
+			OidcPostLogoutUrl:      strings.TrimSpace(c.OidcPostLogoutUrl),
+			OidcTlsCertFiles:       trimAll(c.OidcTlsCertFiles),
+			OidcTlsKeyFiles:        trimAll(c.OidcTlsKeyFiles),
+			FwdAuthAddr:            strings.TrimSpace(c.FwdAuthAddr),
+			FwdAuthTlsCertFiles:    trimAll(c.FwdAuthTlsCertFiles),
+			FwdAuthTlsKeyFiles:     trimAll(c.FwdAuthTlsKeyFiles),
 			NoAuthEnable:           c.NoAuthEnable,
 			NoAuthAddr:             strings.TrimSpace(c.NoAuthAddr),
+			NoAuthTlsCertFiles:     trimAll(c.NoAuthTlsCertFiles),
+			NoAuthTlsKeyFiles:      trimAll(c.NoAuthTlsKeyFiles),
 			DevSessionDuration:     c.DevSessionDuration,
 			DevDisableSecureCookie: c.DevDisableSecureCookie,
+			DevSlidingSession:      c.DevSlidingSession,
+			DevLogoutPath:          strings.TrimSpace(c.DevLogoutPath),
+			DevLoginPath:           strings.TrimSpace(c.DevLoginPath),
+			DevSessionsPath:        strings.TrimSpace(c.DevSessionsPath),
+			DevSessionAdmins:       trimAll(c.DevSessionAdmins),
+			DevLoginMaxAttempts:    c.DevLoginMaxAttempts,
+			DevLoginLockout:        c.DevLoginLockout,
+			DevTlsCertFiles:        trimAll(c.DevTlsCertFiles),
+			DevTlsKeyFiles:         trimAll(c.DevTlsKeyFiles),
 			ContentSecurityPolicy:  c.ContentSecurityPolicy,
+			UpstreamStatusPath:     strings.TrimSpace(c.UpstreamStatusPath),
+			JwksPath:               strings.TrimSpace(c.JwksPath),
+			JwtIssuer:              strings.TrimSpace(c.JwtIssuer),
+			JwtTtl:                 c.JwtTtl,
+			JwtClaims:              jwtClaims,
+			JwtOmitExtClaims:       c.JwtOmitExtClaims,
+			StripHeaders:           trimAll(c.StripHeaders),
 		}
 
-		if strings.TrimSpace(c.JwtEc256) != "" {
-			key, err := jwt.ParseECPrivateKeyFromPEM([]byte(strings.TrimSpace(c.JwtEc256)))
+		if strings.TrimSpace(c.DevUsersFile) != "" {
+			users, err := dev.LoadUsers(strings.TrimSpace(c.DevUsersFile))
 			if err != nil {
-				log.New().WithError(err).Fatal("error to parsing ECDSA private key")
+				log.New().WithError(err).Fatal("error loading DEV_USERS_FILE")
+			}
+			cfg.DevUsers = users
+		}
+
+		if strings.TrimSpace(c.DevLoginPageFile) != "" {
+			cfg.DevLoginPage, err = dev.LoadLoginPage(strings.TrimSpace(c.DevLoginPageFile))
+			if err != nil {
+				log.New().WithError(err).Fatal("error loading DEV_LOGIN_PAGE_FILE")
+			}
+		}
+
+		if c.DevCfEmulation {
+			cfg.DevCfEmulation, err = dev.NewCfEmulation(
+				strings.TrimSpace(c.DevCfAud),
+				strings.TrimSuffix(strings.TrimSpace(c.DevCfIssuer), "/"),
+				strings.TrimSpace(c.DevAllowedUserSuffix),
+			)
+			if err != nil {
+				log.New().WithError(err).Fatal("error setting up DEV_CF_EMULATION")
+			}
+		}
+
+		cfg.DevSessions, err = dev.NewSessions(strings.TrimSpace(c.DevSessionsFile), c.DevSessionDuration)
+		if err != nil {
+			log.New().WithError(err).Fatal("error loading DEV_SESSIONS_FILE")
+		}
+
+		if strings.TrimSpace(c.ErrorPagesDir) != "" {
+			pages, err := errorpage.Load(strings.TrimSpace(c.ErrorPagesDir))
+			if err != nil {
+				log.New().WithError(err).Fatal("error loading ERROR_PAGES_DIR")
 			}
-			cfg.JwtEc256 = key
+			cfg.ErrorPages = pages
 		}
 
-		if strings.TrimSpace(c.JwtEc256Pub) != "" {
-			key, err := jwt.ParseECPublicKeyFromPEM([]byte(strings.TrimSpace(c.JwtEc256Pub)))
+		var verifyKeys []*ecdsa.PublicKey
+		for _, pem := range []string{c.JwtEc256Pub, c.JwtEc256Verify} {
+			if strings.TrimSpace(pem) == "" {
+				continue
+			}
+			_, pubs, err := keyset.ParsePEM([]byte(strings.TrimSpace(pem)))
 			if err != nil {
 				log.New().WithError(err).Fatal("error to parsing ECDSA public key")
 			}
-			cfg.JwtEc256Pub = key
+			verifyKeys = append(verifyKeys, pubs...)
+		}
+
+		if strings.TrimSpace(c.JwtActiveKey) != "" && strings.TrimSpace(c.JwtKeysDir) == "" {
+			log.New().Fatal("error: JWT_ACTIVE_KEY requires JWT_KEYS_DIR")
+		}
+		if strings.TrimSpace(c.JwtKeysDir) != "" {
+			keys, err := keyset.LoadDir(strings.TrimSpace(c.JwtKeysDir), strings.TrimSpace(c.JwtActiveKey), verifyKeys...)
+			if err != nil {
+				log.New().WithError(err).Fatal("error loading JWT_KEYS_DIR")
+			}
+			cfg.JwtKeys = keys
+		} else if strings.TrimSpace(c.JwtEc256) != "" {
+			key, err := jwt.ParseECPrivateKeyFromPEM([]byte(strings.TrimSpace(c.JwtEc256)))
+			if err != nil {
+				log.New().WithError(err).Fatal("error to parsing ECDSA private key")
+			}
+			cfg.JwtKeys, err = keyset.New(key, verifyKeys...)
+			if err != nil {
+				log.New().WithError(err).Fatal("error creating key set")
+			}
+		}
+
+		if cfg.JwksPath != "" && cfg.JwtKeys == nil {
+			log.New().Fatal("error: JWKS_PATH requires JWT_EC_256 or JWT_KEYS_DIR")
 		}
 	})
 	return cfg
@@ -109,22 +325,91 @@ type Config struct {
 	Routes                 []epoxy.Route
 	PublicDir              string
 	PublicPrefix           string
+	PublicHosts            []PublicHost
 	CfAddr                 string
-	CfJwkUrl               string
-	CfAppAud               string
+	CfApps                 []cf.App
+	CfTokenSources         []string
+	CfTlsCertFiles         []string
+	CfTlsKeyFiles          []string
 	DevAddr                string
 	DevAllowedUserSuffix   string
 	DevBcryptHash          string
 	DevSessionDuration     time.Duration
 	DevDisableSecureCookie bool
+	DevUsers               *dev.Users
+	DevSlidingSession      bool
+	DevSessions            *dev.Sessions
+	DevLogoutPath          string
+	DevLoginPath           string
+	DevLoginPage           *template.Template
+	DevSessionsPath        string
+	DevSessionAdmins       []string
+	DevLoginMaxAttempts    int
+	DevLoginLockout        time.Duration
+	DevCfEmulation         *dev.CfEmulation
+	DevTlsCertFiles        []string
+	DevTlsKeyFiles         []string
 	ExtJwkUrl              string
 	ExtJwtUrl              string
 	ExtJwtSubjectPath      string
+	ExtJwtForServiceTokens bool
+	ExtJwtIssuer           string
+	ExtJwtAudiences        []string
+	OidcAddr               string
+	OidcIssuer             string
+	OidcClientId           string
+	OidcClientSecret       string
+	OidcRedirectUrl        string
+	OidcScopes             []string
+	OidcSessionKey         []byte
+	OidcSessionDuration    time.Duration
+	OidcSubjectPath        string
+	OidcLogoutPath         string
+	OidcPostLogoutUrl      string
+	OidcTlsCertFiles       []string
+	OidcTlsKeyFiles        []string
+	FwdAuthAddr            string
+	FwdAuthTlsCertFiles    []string
+	FwdAuthTlsKeyFiles     []string
 	NoAuthEnable           bool
 	NoAuthAddr             string
-	JwtEc256               *ecdsa.PrivateKey
-	JwtEc256Pub            *ecdsa.PublicKey
+	NoAuthTlsCertFiles     []string
+	NoAuthTlsKeyFiles      []string
+	JwtKeys                *keyset.KeySet
+	JwksPath               string
+	JwtIssuer              string
+	JwtTtl                 time.Duration
+	JwtClaims              map[string]string
+	JwtOmitExtClaims       bool
 	ContentSecurityPolicy  string
+	UpstreamStatusPath     string
+	ErrorPages             *errorpage.Pages
+	StripHeaders           []string
+}
+
+func trimAll(values []string) []string {
+	var trimmed []string
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			trimmed = append(trimmed, v)
+		}
+	}
+	return trimmed
+}
+
+// lowerAll trims and lowercases values, dropping empty ones.
+func lowerAll(values []string) []string {
+	values = trimAll(values)
+	for i, v := range values {
+		values[i] = strings.ToLower(v)
+	}
+	return values
+}
+
+type PublicHost struct {
+	Host   string `json:"host"`
+	Dir    string `json:"dir"`
+	Prefix string `json:"prefix,omitempty"`
 }
 
 func parseRoutes(routesString string) ([]epoxy.Route, error) {
@@ -147,11 +432,61 @@ func parseRoutes(routesString string) ([]epoxy.Route, error) {
 		default:
 			return nil, errors.New("route mode required (Prefix/PrefixStrip)")
 		}
-		routes = append(routes, epoxy.Route{
+		host, prefix := splitHostPrefix(parts[1])
+		route := epoxy.Route{
+			Host:   host,
 			Strip:  strip,
-			Prefix: parts[1],
-			Target: parts[2],
-		})
+			Prefix: prefix,
+		}
+		targets := strings.Split(parts[2], ",")
+		for i, t := range targets {
+			targets[i] = strings.TrimSpace(t)
+			if targets[i] == "" {
+				return nil, errors.New("empty target in comma separated targets")
+			}
+		}
+		if len(targets) > 1 {
+			route.Targets = targets
+		} else {
+			route.Target = targets[0]
+		}
+		routes = append(routes, route)
 	}
 	return routes, nil
 }
+
+func parsePublicHosts(publicHostsString string) ([]PublicHost, error) {
+	var publicHosts []PublicHost
+	err := json.Unmarshal([]byte(publicHostsString), &publicHosts)
+	if err == nil && len(publicHosts) > 0 {
+		return publicHosts, nil
+	}
+	for _, l := range strings.Split(publicHostsString, "\n") {
+		parts := strings.Fields(l)
+		if len(parts) != 2 && len(parts) != 3 {
+			return nil, errors.New("2 or 3 tokens per line required (host, dir and optional prefix)")
+		}
+		publicHost := PublicHost{
+			Host: parts[0],
+			Dir:  parts[1],
+		}
+		if len(parts) == 3 {
+			publicHost.Prefix = parts[2]
+		}
+		publicHosts = append(publicHosts, publicHost)
+	}
+	return publicHosts, nil
+}
+
+// splitHostPrefix splits a route pattern such as "app.example.com/api" into host and path prefix,
+// patterns starting with "/" have no host.
+func splitHostPrefix(pattern string) (string, string) {
+	if strings.HasPrefix(pattern, "/") {
+		return "", pattern
+	}
+	host, prefix, found := strings.Cut(pattern, "/")
+	if !found {
+		return host, "/"
+	}
+	return host, "/" + prefix
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseRoutesTargets(t *testing.T) {
+	for _, tc := range []struct {
+		routes  string
+		target  string
+		targets []string
+		err     bool
+	}{
+		{routes: "Prefix /api http://a:8080", target: "http://a:8080"},
+		{routes: "Prefix /api http://a:8080,http://b:8080", targets: []string{"http://a:8080", "http://b:8080"}},
+		{routes: "Prefix /api http://a:8080,", err: true},
+		{routes: "Prefix /api ,http://a:8080", err: true},
+		{routes: "Prefix /api http://a:8080,,http://b:8080", err: true},
+	} {
+		t.Run(tc.routes, func(t *testing.T) {
+			routes, err := parseRoutes(tc.routes)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", routes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if routes[0].Target != tc.target || !slices.Equal(routes[0].Targets, tc.targets) {
+				t.Errorf("expected target %q and targets %v, got %q and %v", tc.target, tc.targets, routes[0].Target, routes[0].Targets)
+			}
+		})
+	}
+}
+
+func TestLowerAll(t *testing.T) {
+	if sources := lowerAll([]string{" Header", "COOKIE ", "", " ", "bearer"}); !slices.Equal(sources, []string{"header", "cookie", "bearer"}) {
+		t.Errorf("expected lowercase sources without empty ones, got %v", sources)
+	}
+}
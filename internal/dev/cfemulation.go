@@ -0,0 +1,152 @@
+package dev
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/modfin/epoxy/internal/cf"
+	"github.com/modfin/epoxy/internal/errorpage"
+	"github.com/modfin/epoxy/internal/keyset"
+	"github.com/modfin/epoxy/internal/log"
+	"github.com/modfin/epoxy/pkg/epoxy"
+	"github.com/modfin/epoxy/pkg/jwk"
+)
+
+const (
+	// CfJwksPath is where Cloudflare Access publishes its keys, relative to the team domain.
+	CfJwksPath = "/cdn-cgi/access/certs"
+	cfTokenTtl = time.Hour
+)
+
+// CfEmulation emulates Cloudflare Access in front of the dev login. It mints a Cf-Access-Jwt-Assertion for the logged
+// in user, signed with a key generated at startup, so requests can be authenticated by the same cf, extjwt and
+// epoxytoken middlewares as in production.
+type CfEmulation struct {
+	aud           string
+	issuer        string
+	allowedSuffix string
+	keys          *keyset.KeySet
+
+	mu     sync.Mutex
+	tokens map[string]cfToken // by email
+}
+
+type cfToken struct {
+	raw     string
+	expires time.Time
+	custom  map[string]any
+}
+
+type cfClaims struct {
+	cf.Claims
+	Custom map[string]any `json:"custom,omitempty"` // extra claims of the user, as custom OIDC claims of an identity provider
+}
+
+// NewCfEmulation creates an emulation minting tokens for aud, issued by issuer if set, to users with emails ending
+// with allowedSuffix.
+func NewCfEmulation(aud string, issuer string, allowedSuffix string) (*CfEmulation, error) {
+	if aud == "" {
+		return nil, errors.New("dev: cf emulation aud required")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := keyset.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &CfEmulation{aud: aud, issuer: issuer, allowedSuffix: allowedSuffix, keys: keys, tokens: make(map[string]cfToken)}, nil
+}
+
+// App returns the Cloudflare Access app accepting the minted tokens.
+func (c *CfEmulation) App() (cf.App, error) {
+	var set jwk.KeySet
+	for _, k := range c.keys.PublicKeys() {
+		key, err := jwk.FromECPublicKey(k)
+		if err != nil {
+			return cf.App{}, err
+		}
+		set.Keys = append(set.Keys, key)
+	}
+	keys, err := jwk.NewStaticProvider(set)
+	if err != nil {
+		return cf.App{}, err
+	}
+	return cf.App{Name: "dev", Issuer: c.issuer, Aud: c.aud, Keys: keys}, nil
+}
+
+// PublicKeys returns the keys verifying the minted tokens, to be published at CfJwksPath.
+func (c *CfEmulation) PublicKeys() []*ecdsa.PublicKey {
+	return c.keys.PublicKeys()
+}
+
+// Middleware sets the Cf-Access-Jwt-Assertion header for the user logged in by dev.Middleware, replacing any sent by
+// the client, if the email of the user has the allowed suffix.
+func (c *CfEmulation) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, err := Email(r.Context())
+		if err != nil {
+			log.New().WithError(err).AddToContext(r.Context())
+			errorpage.Write(w, r, http.StatusUnauthorized)
+			return
+		}
+		if !AllowedEmail(email, c.allowedSuffix) {
+			log.New().WithError(errors.New("dev: cf emulation email not allowed")).AddToContext(r.Context())
+			errorpage.Write(w, r, http.StatusUnauthorized)
+			return
+		}
+		var custom map[string]any
+		if id, ok := epoxy.IdentityFromContext(r.Context()); ok {
+			custom = id.Claims
+		}
+		token, err := c.token(email, custom)
+		if err != nil {
+			log.New().WithError(err).AddToContext(r.Context())
+			errorpage.Write(w, r, http.StatusInternalServerError)
+			return
+		}
+		r.Header.Set("Cf-Access-Jwt-Assertion", token)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// token returns the token of email, minted again when less than half of its lifetime is left or the claims changed.
+func (c *CfEmulation) token(email string, custom map[string]any) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.tokens[email]; ok && time.Until(t.expires) > cfTokenTtl/2 && reflect.DeepEqual(t.custom, custom) {
+		return t.raw, nil
+	}
+	now := time.Now()
+	claims := cfClaims{
+		Claims: cf.Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    c.issuer,
+				Subject:   uuid.NewSHA1(uuid.NameSpaceURL, []byte("mailto:"+email)).String(),
+				Audience:  jwt.ClaimStrings{c.aud},
+				IssuedAt:  jwt.NewNumericDate(now),
+				NotBefore: jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(cfTokenTtl)),
+			},
+			Email:         email,
+			Type:          "app",
+			IdentityNonce: uuid.NewString(),
+		},
+		Custom: custom,
+	}
+	raw, err := c.keys.Sign(claims)
+	if err != nil {
+		return "", err
+	}
+	c.tokens[email] = cfToken{raw: raw, expires: claims.ExpiresAt.Time, custom: custom}
+	return raw, nil
+}
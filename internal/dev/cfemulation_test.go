@@ -0,0 +1,40 @@
+package dev
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/modfin/epoxy/internal/log"
+)
+
+func TestCfEmulationAllowedSuffix(t *testing.T) {
+	emulation, err := NewCfEmulation("epoxy-dev", "", "@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := log.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email := r.Header.Get("X-Test-Email")
+		r = r.WithContext(context.WithValue(r.Context(), contextKey{}, email))
+		emulation.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Cf-Access-Jwt-Assertion") == "" {
+				t.Error("expected minted token")
+			}
+		})).ServeHTTP(w, r)
+	}))
+	for email, status := range map[string]int{
+		"alice@test.com":   http.StatusOK,
+		"alice@other.com":  http.StatusUnauthorized,
+		"@test.com":        http.StatusUnauthorized,
+		"alice@test.com.x": http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Test-Email", email)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Errorf("%s: expected %d, got %d", email, status, rec.Code)
+		}
+	}
+}
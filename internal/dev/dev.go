@@ -2,140 +2,290 @@ package dev
 
 import (
 	"context"
-	"crypto/ecdsa"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/modfin/epoxy/internal/errorpage"
+	"github.com/modfin/epoxy/internal/keyset"
+	"github.com/modfin/epoxy/internal/localhost"
 	"github.com/modfin/epoxy/internal/log"
 	"github.com/modfin/epoxy/pkg/epoxy"
 	"golang.org/x/crypto/bcrypt"
-	"io"
+	"html/template"
+	"net"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 )
 
 type contextKey struct{}
 
-const cookieName = "epoxy-dev"
+const (
+	cookieName     = "epoxy-dev"
+	csrfCookieName = "epoxy-dev-csrf"
+)
+
+// Options configures the dev mode login.
+type Options struct {
+	BcryptHash          string             // shared password of all users, if there is no Users file
+	Users               *Users             // users with their own passwords
+	SessionDuration     time.Duration      // of the session cookie
+	SlidingSession      bool               // renew the session cookie when less than half of SessionDuration is left
+	Sessions            *Sessions          // issued and revoked sessions, kept in memory if nil
+	LogoutPath          string             // e.g. /dev/logout
+	LoginPath           string             // serves the login page, and takes logins whether logged in or not, if set
+	LoginPage           *template.Template // executed with LoginPage, the default page if nil
+	SessionsPath        string             // lists active sessions, and revokes them on POST with id or email, if set
+	SessionAdmins       []string           // emails of users managing the sessions of all users, others only their own
+	MaxLoginAttempts    int                // failed logins per client ip or email before lockout, default 10
+	LoginLockout        time.Duration      // default 15m
+	Keys                *keyset.KeySet     // signing the session cookie
+	DisableSecureCookie bool               // allow the session cookie over plain HTTP on other hosts than localhost
+}
 
-func Middleware(bcryptHash string, sessionDuration time.Duration, jwtEc256 *ecdsa.PrivateKey, jwtEc256Pub *ecdsa.PublicKey, devDisableSecure bool) epoxy.Middleware {
-	if bcryptHash == "" {
-		log.New().Fatal("dev: bcrypt hash required")
+// Middleware authenticates requests with a session cookie, set after logging in with the form or a JSON POST. Users authenticate with
+// their password in the Users file if set, otherwise with the shared password of BcryptHash.
+func Middleware(o Options) epoxy.Middleware {
+	if o.BcryptHash == "" && o.Users == nil {
+		log.New().Fatal("dev: bcrypt hash or users file required")
 	}
-	if sessionDuration.Milliseconds() <= 0 {
+	if o.Keys == nil {
+		log.New().Fatal("dev: jwt keys required")
+	}
+	if o.SessionDuration.Milliseconds() <= 0 {
 		log.New().Fatal("dev: session duration negative or zero")
 	}
+	if o.Sessions == nil {
+		o.Sessions, _ = NewSessions("", o.SessionDuration)
+	}
+	if o.MaxLoginAttempts <= 0 {
+		o.MaxLoginAttempts = 10
+	}
+	if o.LoginLockout <= 0 {
+		o.LoginLockout = 15 * time.Minute
+	}
+	logins := newThrottle(o.MaxLoginAttempts, o.LoginLockout)
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			cookie, err := r.Cookie(cookieName)
-			if err == nil && cookie.Valid() == nil {
-				var c claims
-				t, err := jwt.ParseWithClaims(cookie.Value, &c, func(t *jwt.Token) (interface{}, error) {
-					if t.Method.Alg() != jwt.SigningMethodES256.Alg() {
-						return nil, fmt.Errorf("unexpected jwt signing method=%v", t.Header["alg"])
-					}
-					return jwtEc256Pub, nil
-				})
-				if err == nil && t.Valid {
-					log.New().WithField("dev_email", c.DevEmail).WithField("dev", "session active").AddToContext(r.Context())
-					ctx := context.WithValue(r.Context(), contextKey{}, c.DevEmail)
-					next.ServeHTTP(w, r.WithContext(ctx))
+			if o.LogoutPath != "" && r.URL.Path == o.LogoutPath {
+				o.logout(w, r)
+				return
+			}
+
+			if o.LoginPath != "" && r.URL.Path == o.LoginPath {
+				if r.Method == http.MethodPost {
+					o.handleLogin(w, r, logins)
 					return
 				}
+				if _, ok := o.session(r); ok {
+					http.Redirect(w, r, o.returnTo(r, r.FormValue("return_to")), http.StatusFound)
+					return
+				}
+				o.renderPage(w, r, http.StatusOK, LoginPage{ReturnTo: o.returnTo(r, r.FormValue("return_to"))})
+				return
 			}
 
-			if r.Method == http.MethodPost {
-				email := r.FormValue("email")
-				password := r.FormValue("password")
-				if bcrypt.CompareHashAndPassword([]byte(bcryptHash), []byte(password)) == nil {
-					exp := time.Now().Add(sessionDuration)
-					devClaims := claims{
-						DevEmail: email,
-						RegisteredClaims: jwt.RegisteredClaims{
-							Issuer:    "epoxy-dev",
-							IssuedAt:  &jwt.NumericDate{Time: time.Now()},
-							ExpiresAt: &jwt.NumericDate{Time: exp},
-						},
+			if c, ok := o.session(r); ok {
+				userClaims, ok := o.userClaims(c.DevEmail)
+				if ok {
+					log.New().WithField("dev_email", c.DevEmail).WithField("dev", "session active").AddToContext(r.Context())
+					if o.SlidingSession && time.Until(c.ExpiresAt.Time) < o.SessionDuration/2 {
+						err := o.issue(w, r, c.DevEmail, c.ID, c.IssuedAt.Time)
+						if err != nil {
+							log.New().WithError(fmt.Errorf("dev: error renewing session: %w", err)).AddToContext(r.Context())
+						} else {
+							log.New().WithField("dev_session_renewed", true).AddToContext(r.Context())
+						}
 					}
-					devJwt, err := jwt.NewWithClaims(jwt.SigningMethodES256, devClaims).SignedString(jwtEc256)
-					if err != nil {
-						log.New().WithError(err).AddToContext(r.Context())
-						w.WriteHeader(http.StatusUnauthorized)
+					if o.SessionsPath != "" && r.URL.Path == o.SessionsPath {
+						o.sessions(w, r, c.DevEmail)
 						return
 					}
-
-					c := &http.Cookie{
-						Name:     cookieName,
-						Value:    devJwt,
-						Path:     "/",
-						Expires:  exp,
-						Secure:   !(r.URL.Host == "localhost" || devDisableSecure),
-						HttpOnly: true,
-						SameSite: http.SameSiteLaxMode,
-					}
-					http.SetCookie(w, c)
-					log.New().WithField("dev_email", email).WithField("dev", "success, set cookie").AddToContext(r.Context())
-					http.Redirect(w, r, r.URL.String(), http.StatusFound)
+					ctx := context.WithValue(r.Context(), contextKey{}, c.DevEmail)
+					ctx = epoxy.WithIdentity(ctx, &epoxy.Identity{Type: epoxy.IdentityDev, Email: c.DevEmail, Claims: userClaims})
+					next.ServeHTTP(w, r.WithContext(ctx))
 					return
-				} else {
-					log.New().WithField("dev_email", email).WithField("dev", "wrong password").AddToContext(r.Context())
-					w.WriteHeader(http.StatusUnauthorized)
 				}
+				log.New().WithField("dev_email", c.DevEmail).WithField("dev", "user removed").AddToContext(r.Context())
+			}
+
+			if r.Method == http.MethodPost {
+				o.handleLogin(w, r, logins)
+				return
 			}
 			log.New().WithField("dev", "not logged in, rendering form").AddToContext(r.Context())
-			_, _ = io.Copy(w, strings.NewReader(page))
-			return
+			o.renderPage(w, r, http.StatusOK, LoginPage{ReturnTo: o.returnTo(r, r.FormValue("return_to"))})
 		})
 	}
 }
 
+// session returns the claims of the session cookie of r, if valid and not revoked.
+func (o Options) session(r *http.Request) (*claims, bool) {
+	cookie, err := r.Cookie(cookieName)
+	if err != nil || cookie.Valid() != nil {
+		return nil, false
+	}
+	var c claims
+	t, err := jwt.ParseWithClaims(cookie.Value, &c, o.Keys.Keyfunc)
+	if err != nil || !t.Valid || c.IssuedAt == nil || c.ExpiresAt == nil {
+		return nil, false
+	}
+	if o.Sessions.Revoked(c.ID, c.DevEmail, c.IssuedAt.Time) {
+		log.New().WithField("dev_email", c.DevEmail).WithField("dev", "session revoked").AddToContext(r.Context())
+		return nil, false
+	}
+	return &c, true
+}
+
+// issue sets a session cookie, for a new session or renewing session id issued at iat.
+func (o Options) issue(w http.ResponseWriter, r *http.Request, email string, id string, iat time.Time) error {
+	exp := time.Now().Add(o.SessionDuration)
+	devClaims := claims{
+		DevEmail: email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			Issuer:    "epoxy-dev",
+			IssuedAt:  &jwt.NumericDate{Time: iat},
+			ExpiresAt: &jwt.NumericDate{Time: exp},
+		},
+	}
+	devJwt, err := o.Keys.Sign(devClaims)
+	if err != nil {
+		return err
+	}
+	err = o.Sessions.Add(Session{Id: id, Email: email, IssuedAt: iat, ExpiresAt: exp})
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, o.cookie(r, devJwt, exp))
+	return nil
+}
+
+func (o Options) cookie(r *http.Request, value string, exp time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     cookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  exp,
+		Secure:   r.TLS != nil || !(localhost.Is(r.Host) || o.DisableSecureCookie),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// logout revokes the session of r, and removes the cookie, on POST with a valid csrf token. Other requests get a form
+// posting the token, so other sites can't log users out with a link.
+func (o Options) logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		o.renderLogoutPage(w, r)
+		return
+	}
+	if !validCsrf(r) {
+		log.New().WithField("dev", "invalid csrf token").AddToContext(r.Context())
+		errorpage.Write(w, r, http.StatusForbidden)
+		return
+	}
+	if c, ok := o.session(r); ok {
+		err := o.Sessions.Revoke(c.ID, c.ExpiresAt.Time)
+		if err != nil {
+			log.New().WithError(fmt.Errorf("dev: error revoking session: %w", err)).AddToContext(r.Context())
+			errorpage.Write(w, r, http.StatusInternalServerError)
+			return
+		}
+		log.New().WithField("dev_email", c.DevEmail).AddToContext(r.Context())
+	}
+	http.SetCookie(w, o.cookie(r, "", time.Unix(0, 0)))
+	log.New().WithField("dev", "logout").AddToContext(r.Context())
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// sessions lists the active sessions of the user with email, or of all users for session admins, revoking a session by
+// id or the sessions of a user by email first on POST with a valid csrf token.
+func (o Options) sessions(w http.ResponseWriter, r *http.Request, email string) {
+	admin := slices.ContainsFunc(o.SessionAdmins, func(a string) bool { return strings.EqualFold(a, email) })
+	if r.Method == http.MethodPost {
+		if !validCsrf(r) {
+			log.New().WithField("dev", "invalid csrf token").AddToContext(r.Context())
+			errorpage.Write(w, r, http.StatusForbidden)
+			return
+		}
+		var err error
+		switch id, revokeEmail := r.FormValue("id"), r.FormValue("email"); {
+		case id != "":
+			if session, ok := o.Sessions.Get(id); !admin && (!ok || !strings.EqualFold(session.Email, email)) {
+				log.New().WithField("dev", "not allowed to revoke session").AddToContext(r.Context())
+				errorpage.Write(w, r, http.StatusForbidden)
+				return
+			}
+			err = o.Sessions.Revoke(id, time.Now().Add(o.SessionDuration))
+			log.New().WithField("dev_revoked_session", id).AddToContext(r.Context())
+		case revokeEmail != "":
+			if !admin && !strings.EqualFold(revokeEmail, email) {
+				log.New().WithField("dev", "not allowed to revoke user").AddToContext(r.Context())
+				errorpage.Write(w, r, http.StatusForbidden)
+				return
+			}
+			err = o.Sessions.RevokeUser(revokeEmail)
+			log.New().WithField("dev_revoked_user", revokeEmail).AddToContext(r.Context())
+		default:
+			errorpage.Write(w, r, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.New().WithError(fmt.Errorf("dev: error revoking: %w", err)).AddToContext(r.Context())
+			errorpage.Write(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+	list := o.Sessions.List()
+	if !admin {
+		list = slices.DeleteFunc(list, func(s Session) bool { return !strings.EqualFold(s.Email, email) })
+	}
+	w.Header().Set("X-Csrf-Token", o.csrfToken(w, r))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+func (o Options) authenticate(email string, password string) bool {
+	if o.Users != nil {
+		_, ok := o.Users.Authenticate(email, password)
+		return ok
+	}
+	return bcrypt.CompareHashAndPassword([]byte(o.BcryptHash), []byte(password)) == nil
+}
+
+// userClaims returns the extra claims of the user, false if the user is no longer in the Users file.
+func (o Options) userClaims(email string) (map[string]any, bool) {
+	if o.Users == nil {
+		return nil, true
+	}
+	return o.Users.Claims(email)
+}
+
+func clientIp(r *http.Request) string {
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return h
+	}
+	return r.RemoteAddr
+}
+
 type claims struct {
 	DevEmail string `json:"dev_email"`
 	jwt.RegisteredClaims
 }
 
+// AllowedEmail reports if email ends with allowedSuffix, e.g. @test.com, and is not just the suffix. Emails are
+// compared case-insensitively.
+func AllowedEmail(email string, allowedSuffix string) bool {
+	email, allowedSuffix = strings.ToLower(email), strings.ToLower(allowedSuffix)
+	return strings.HasSuffix(email, allowedSuffix) && strings.TrimSpace(strings.TrimSuffix(email, allowedSuffix)) != ""
+}
+
 func Email(ctx context.Context) (string, error) {
 	if u, ok := ctx.Value(contextKey{}).(string); ok {
 		return u, nil
 	}
 	return "", errors.New("couldn't get dev email from context, make sure dev.Middleware has run")
 }
-
-const page = `
-<!doctype html>
-<html>
-<head>
-   <meta name="viewport" content="width=device-width, user-scalable=no, initial-scale=1.0, maximum-scale=1.0, minimum-scale=1.0">
-   <title>Epoxy Dev Login</title>
-</head>
-<body>
-	<form method="post">
-		<div>
-			<label for="email">Email</label>
-			<input type="email" id="email" name="email">
-		</div>
-		<div>
-			<label for="password">Password</label>
-			<input type="password" id="password" name="password">
-		</div>
-		<input type="submit" />
-	</form>
-</body>
-</html>
-<style>
-form {
-	margin-top: 100px;
-	margin-left: auto;
-    margin-right: auto;
-    width: 250px;
-	display: flex;
-    flex-direction: column;
-	gap: 10px;
-}
-form div {
-	display: flex;
-	justify-content: space-between;
-}
-</style>
-`
@@ -0,0 +1,203 @@
+package dev
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modfin/epoxy/internal/keyset"
+	"github.com/modfin/epoxy/internal/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testAdmin = "admin@test.com"
+	testAlice = "alice@test.com"
+	testBob   = "bob@test.com"
+)
+
+func newTestOptions(t *testing.T) Options {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keyset.New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ := NewSessions("", time.Hour)
+	return Options{
+		BcryptHash:      string(hash),
+		SessionDuration: time.Hour,
+		Sessions:        sessions,
+		SessionsPath:    "/dev/sessions",
+		SessionAdmins:   []string{testAdmin},
+		Keys:            keys,
+	}
+}
+
+// loggedIn issues a session for email, and returns its id and cookie.
+func loggedIn(t *testing.T, o Options, email string) (string, *http.Cookie) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	id := email + "-session"
+	err := o.issue(rec, httptest.NewRequest(http.MethodGet, "/", nil), email, id, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, rec.Result().Cookies()[0]
+}
+
+func sessionsRequest(h http.Handler, session *http.Cookie, csrf string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/dev/sessions", nil)
+	if form != nil {
+		req = httptest.NewRequest(http.MethodPost, "/dev/sessions", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.AddCookie(session)
+	if csrf != "" {
+		req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: csrf})
+		req.Header.Set("X-Csrf-Token", csrf)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func listed(t *testing.T, rec *httptest.ResponseRecorder) []string {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var list []Session
+	err := json.NewDecoder(rec.Body).Decode(&list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var emails []string
+	for _, s := range list {
+		emails = append(emails, s.Email)
+	}
+	return emails
+}
+
+func TestSessions(t *testing.T) {
+	o := newTestOptions(t)
+	h := log.Middleware(Middleware(o)(http.NotFoundHandler()))
+	_, admin := loggedIn(t, o, testAdmin)
+	aliceId, alice := loggedIn(t, o, testAlice)
+	bobId, bob := loggedIn(t, o, testBob)
+
+	rec := sessionsRequest(h, alice, "", nil)
+	csrf := rec.Header().Get("X-Csrf-Token")
+	if emails := listed(t, rec); strings.Join(emails, ",") != testAlice {
+		t.Fatalf("expected only the own session, got %v", emails)
+	}
+	if csrf == "" {
+		t.Fatal("expected csrf token")
+	}
+	if emails := listed(t, sessionsRequest(h, admin, "", nil)); len(emails) != 3 {
+		t.Fatalf("expected all sessions for admins, got %v", emails)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		session *http.Cookie
+		csrf    string
+		form    url.Values
+		status  int
+	}{
+		{name: "no csrf token", session: alice, form: url.Values{"id": {aliceId}}, status: http.StatusForbidden},
+		{name: "session of other user", session: alice, csrf: csrf, form: url.Values{"id": {bobId}}, status: http.StatusForbidden},
+		{name: "unknown session", session: alice, csrf: csrf, form: url.Values{"id": {"unknown"}}, status: http.StatusForbidden},
+		{name: "other user", session: alice, csrf: csrf, form: url.Values{"email": {testBob}}, status: http.StatusForbidden},
+		{name: "admin without csrf token", session: admin, form: url.Values{"email": {testBob}}, status: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := sessionsRequest(h, tc.session, tc.csrf, tc.form)
+			if rec.Code != tc.status {
+				t.Fatalf("expected %d, got %d", tc.status, rec.Code)
+			}
+		})
+	}
+	if rec := sessionsRequest(h, bob, "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected session of bob not to be revoked, got %d", rec.Code)
+	}
+
+	if emails := listed(t, sessionsRequest(h, admin, csrf, url.Values{"email": {testBob}})); len(emails) != 2 {
+		t.Fatalf("expected sessions of bob revoked by admin, got %v", emails)
+	}
+	if rec := sessionsRequest(h, bob, "", nil); !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatal("expected the login page for the revoked session of bob")
+	}
+	if emails := listed(t, sessionsRequest(h, alice, csrf, url.Values{"id": {aliceId}})); len(emails) != 0 {
+		t.Fatalf("expected own session revoked, got %v", emails)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	o := newTestOptions(t)
+	o.LogoutPath = "/dev/logout"
+	h := log.Middleware(Middleware(o)(http.NotFoundHandler()))
+	id, session := loggedIn(t, o, testAlice)
+	csrf := strings.Repeat("c", 32)
+
+	logout := func(method string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/dev/logout", strings.NewReader(url.Values{"csrf_token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(session)
+		req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: csrf})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := logout(http.MethodGet, ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), csrf) {
+		t.Fatalf("expected logout form with csrf token, got %d", rec.Code)
+	}
+	if rec := logout(http.MethodPost, "other"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without valid csrf token, got %d", rec.Code)
+	}
+	if o.Sessions.Revoked(id, testAlice, time.Now()) {
+		t.Fatal("expected session not to be revoked without POST and csrf token")
+	}
+	if rec := logout(http.MethodPost, csrf); rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected logout, got %d", rec.Code)
+	}
+	if !o.Sessions.Revoked(id, testAlice, time.Now()) {
+		t.Fatal("expected session to be revoked")
+	}
+}
+
+func TestAllowedEmail(t *testing.T) {
+	for _, tc := range []struct {
+		email   string
+		suffix  string
+		allowed bool
+	}{
+		{email: "alice@test.com", suffix: "@test.com", allowed: true},
+		{email: "Alice@Test.COM", suffix: "@test.com", allowed: true},
+		{email: "alice@test.com", suffix: "@Test.com", allowed: true},
+		{email: "alice@test.com", suffix: "", allowed: true},
+		{email: "alice@other.com", suffix: "@test.com"},
+		{email: "alice@test.com.evil", suffix: "@test.com"},
+		{email: "@test.com", suffix: "@test.com"},
+		{email: " @TEST.com", suffix: "@test.com"},
+	} {
+		if allowed := AllowedEmail(tc.email, tc.suffix); allowed != tc.allowed {
+			t.Errorf("%q with suffix %q: expected %t, got %t", tc.email, tc.suffix, tc.allowed, allowed)
+		}
+	}
+}
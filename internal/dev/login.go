@@ -0,0 +1,313 @@
+package dev
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/modfin/epoxy/internal/errorpage"
+	"github.com/modfin/epoxy/internal/log"
+)
+
+// LoginPage is the data the login page template is executed with.
+type LoginPage struct {
+	Action    string // url the form posts to, empty for the current url
+	CsrfToken string // to be posted as csrf_token
+	ReturnTo  string // to be posted as return_to
+	Email     string // of a failed login
+	Error     string // why the login failed
+}
+
+// LoadLoginPage loads an html template for the login page from file, executed with LoginPage.
+func LoadLoginPage(file string) (*template.Template, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("login").Parse(string(b))
+}
+
+type loginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	ReturnTo string `json:"return_to"`
+}
+
+// loginError is a failed login, with the message shown to the user.
+type loginError struct {
+	status     int
+	message    string
+	retryAfter time.Duration
+}
+
+// handleLogin logs in with the posted form, redirecting to return_to, or with a JSON body answered with JSON.
+func (o Options) handleLogin(w http.ResponseWriter, r *http.Request, logins *throttle) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isJson := mediaType == "application/json"
+	var req loginRequest
+	if isJson {
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req)
+		if err != nil {
+			log.New().WithError(fmt.Errorf("dev: invalid login request: %w", err)).AddToContext(r.Context())
+			writeJson(w, http.StatusBadRequest, map[string]any{"error": "invalid login request"})
+			return
+		}
+	} else {
+		req = loginRequest{Email: r.FormValue("email"), Password: r.FormValue("password"), ReturnTo: r.FormValue("return_to")}
+	}
+	// emails are case-insensitive, sessions and tokens carry them lowercase
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	req.ReturnTo = o.returnTo(r, req.ReturnTo)
+
+	var failed *loginError
+	// JSON requests can't be sent cross-site without a CORS preflight, so only the form needs a csrf token
+	if !isJson && !validCsrf(r) {
+		log.New().WithField("dev_email", req.Email).WithField("remote_ip", clientIp(r)).WithField("audit", "dev_login_csrf").Info("dev login with invalid csrf token")
+		log.New().WithField("dev_email", req.Email).WithField("dev", "invalid csrf token").AddToContext(r.Context())
+		failed = &loginError{status: http.StatusForbidden, message: "The login form expired, please try again."}
+	} else {
+		failed = o.login(w, r, logins, req.Email, req.Password)
+	}
+
+	if failed == nil {
+		log.New().WithField("dev_email", req.Email).WithField("dev", "success, set cookie").AddToContext(r.Context())
+		if isJson {
+			writeJson(w, http.StatusOK, map[string]any{"email": req.Email, "return_to": req.ReturnTo})
+			return
+		}
+		http.Redirect(w, r, req.ReturnTo, http.StatusFound)
+		return
+	}
+	if failed.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(failed.retryAfter.Seconds())+1))
+	}
+	if isJson {
+		writeJson(w, failed.status, map[string]any{"error": failed.message})
+		return
+	}
+	o.renderPage(w, r, failed.status, LoginPage{ReturnTo: req.ReturnTo, Email: req.Email, Error: failed.message})
+}
+
+// login authenticates email and password, throttled per client ip and email, and sets the session cookie.
+func (o Options) login(w http.ResponseWriter, r *http.Request, logins *throttle, email string, password string) *loginError {
+	ip := clientIp(r)
+	ipKey, emailKey := "ip:"+ip, "email:"+email
+	audit := func() log.LogEvent {
+		return log.New().WithField("dev_email", email).WithField("remote_ip", ip)
+	}
+
+	wait, failures, locked := logins.attempt(ipKey, emailKey)
+	if wait > 0 {
+		audit().WithField("audit", "dev_login_throttled").WithField("retry_after", wait.String()).Info("dev login throttled")
+		log.New().WithField("dev_email", email).WithField("dev", "throttled").AddToContext(r.Context())
+		return &loginError{
+			status:     http.StatusTooManyRequests,
+			message:    fmt.Sprintf("Too many failed logins, try again in %s.", wait.Round(time.Second)),
+			retryAfter: wait,
+		}
+	}
+
+	if !o.authenticate(email, password) {
+		// the attempt is already recorded as failed
+		ipFailures, emailFailures := failures[0], failures[1]
+		ipLocked, emailLocked := locked[0], locked[1]
+		audit().
+			WithField("audit", "dev_login_failed").
+			WithField("ip_failures", ipFailures).
+			WithField("email_failures", emailFailures).
+			Info("dev login failed")
+		log.New().WithField("dev_email", email).WithField("dev", "wrong password").AddToContext(r.Context())
+		if ipLocked || emailLocked {
+			audit().
+				WithField("audit", "dev_login_lockout").
+				WithField("ip_locked", ipLocked).
+				WithField("email_locked", emailLocked).
+				WithField("lockout", o.LoginLockout.String()).
+				Info("dev login locked out")
+			return &loginError{
+				status:     http.StatusTooManyRequests,
+				message:    fmt.Sprintf("Too many failed logins, try again in %s.", o.LoginLockout),
+				retryAfter: o.LoginLockout,
+			}
+		}
+		return &loginError{status: http.StatusUnauthorized, message: "Wrong email or password."}
+	}
+
+	// the earlier failures of the ip are kept until they expire, so logging in to an own account doesn't reset the
+	// failures of guessing the passwords of others
+	logins.release(ipKey)
+	logins.succeed(emailKey)
+	err := o.issue(w, r, email, uuid.NewString(), time.Now())
+	if err != nil {
+		log.New().WithError(err).AddToContext(r.Context())
+		return &loginError{status: http.StatusInternalServerError, message: "Could not log in, please try again."}
+	}
+	return nil
+}
+
+// returnTo returns the local url to return to after logging in, the requested url if the form is shown in its place.
+func (o Options) returnTo(r *http.Request, returnTo string) string {
+	if returnTo == "" && r.URL.Path != o.LoginPath {
+		returnTo = r.URL.RequestURI()
+	}
+	return localUrl(returnTo)
+}
+
+// localUrl returns the path and query of returnTo if it is a local url, "/" otherwise. Urls with control characters
+// are rejected, as browsers strip them and could read e.g. "/\t/evil.com" as another host.
+func localUrl(returnTo string) string {
+	if strings.ContainsFunc(returnTo, unicode.IsControl) || strings.Contains(returnTo, "\\") {
+		return "/"
+	}
+	u, err := url.Parse(returnTo)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil || !strings.HasPrefix(u.Path, "/") {
+		return "/"
+	}
+	target := u.RequestURI()
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		return "/"
+	}
+	return target
+}
+
+// renderPage renders the login page with status, with a csrf token matching the csrf cookie.
+func (o Options) renderPage(w http.ResponseWriter, r *http.Request, status int, page LoginPage) {
+	page.CsrfToken = o.csrfToken(w, r)
+	page.Action = o.LoginPath
+
+	t := o.LoginPage
+	if t == nil {
+		t = defaultLoginPage
+	}
+	var buf strings.Builder
+	if err := t.Execute(&buf, page); err != nil {
+		log.New().WithError(fmt.Errorf("dev: error executing login page: %w", err)).AddToContext(r.Context())
+		errorpage.Write(w, r, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(buf.String()))
+}
+
+// csrfToken returns the csrf token of the csrf cookie, setting the cookie with a new token if missing.
+func (o Options) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookieName); err == nil && len(c.Value) >= 32 {
+		return c.Value
+	}
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	token := base64.RawURLEncoding.EncodeToString(b)
+	c := o.cookie(r, token, time.Time{})
+	c.Name = csrfCookieName
+	c.SameSite = http.SameSiteStrictMode
+	http.SetCookie(w, c)
+	return token
+}
+
+// renderLogoutPage renders a form posting the logout with a csrf token.
+func (o Options) renderLogoutPage(w http.ResponseWriter, r *http.Request) {
+	var buf strings.Builder
+	err := logoutPage.Execute(&buf, LoginPage{Action: o.LogoutPath, CsrfToken: o.csrfToken(w, r)})
+	if err != nil {
+		log.New().WithError(fmt.Errorf("dev: error executing logout page: %w", err)).AddToContext(r.Context())
+		errorpage.Write(w, r, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(buf.String()))
+}
+
+// validCsrf reports if the csrf token of the form, or of the X-Csrf-Token header, matches the csrf cookie.
+func validCsrf(r *http.Request) bool {
+	c, err := r.Cookie(csrfCookieName)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	token := r.FormValue("csrf_token")
+	if token == "" {
+		token = r.Header.Get("X-Csrf-Token")
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(token)) == 1
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+var defaultLoginPage = template.Must(template.New("login").Parse(loginPage))
+
+var logoutPage = template.Must(template.New("logout").Parse(`
+<!doctype html>
+<html>
+<head>
+   <meta name="viewport" content="width=device-width, user-scalable=no, initial-scale=1.0, maximum-scale=1.0, minimum-scale=1.0">
+   <title>Epoxy Dev Logout</title>
+</head>
+<body>
+	<form method="post" action="{{.Action}}" style="margin: 100px auto; width: 250px;">
+		<input type="hidden" name="csrf_token" value="{{.CsrfToken}}">
+		<input type="submit" value="Log out" autofocus />
+	</form>
+</body>
+</html>
+`))
+
+const loginPage = `
+<!doctype html>
+<html>
+<head>
+   <meta name="viewport" content="width=device-width, user-scalable=no, initial-scale=1.0, maximum-scale=1.0, minimum-scale=1.0">
+   <title>Epoxy Dev Login</title>
+</head>
+<body>
+	<form method="post"{{if .Action}} action="{{.Action}}"{{end}}>
+		<input type="hidden" name="csrf_token" value="{{.CsrfToken}}">
+		<input type="hidden" name="return_to" value="{{.ReturnTo}}">
+		{{if .Error}}<p class="error" role="alert">{{.Error}}</p>{{end}}
+		<div>
+			<label for="email">Email</label>
+			<input type="email" id="email" name="email" value="{{.Email}}" autocomplete="username" required>
+		</div>
+		<div>
+			<label for="password">Password</label>
+			<input type="password" id="password" name="password" autocomplete="current-password" required{{if .Email}} autofocus{{end}}>
+		</div>
+		<input type="submit" />
+	</form>
+</body>
+</html>
+<style>
+form {
+	margin-top: 100px;
+	margin-left: auto;
+    margin-right: auto;
+    width: 250px;
+	display: flex;
+    flex-direction: column;
+	gap: 10px;
+}
+form div {
+	display: flex;
+	justify-content: space-between;
+}
+form .error {
+	margin: 0;
+	color: #b00020;
+}
+</style>
+`
@@ -0,0 +1,103 @@
+package dev
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/modfin/epoxy/internal/log"
+)
+
+func TestLocalUrl(t *testing.T) {
+	for returnTo, expected := range map[string]string{
+		"":                       "/",
+		"/":                      "/",
+		"/app":                   "/app",
+		"/app?x=1&y=2":           "/app?x=1&y=2",
+		"/app#fragment":          "/app",
+		"/a b":                   "/a%20b",
+		"app":                    "/",
+		"//evil.com":             "/",
+		"///evil.com":            "/",
+		"/\\evil.com":            "/",
+		"/\t/evil.com":           "/",
+		"/\n/evil.com":           "/",
+		"/\r\n/evil.com":         "/",
+		"\t//evil.com":           "/",
+		"/%09/evil.com":          "/%09/evil.com",
+		"/%2F/evil.com":          "/%2F/evil.com",
+		"https://evil.com/":      "/",
+		"javascript:alert(1)":    "/",
+		"//user@evil.com":        "/",
+		"http:/evil.com":         "/",
+		"/app/../../evil.com":    "/app/../../evil.com",
+		"/login?return_to=//x.y": "/login?return_to=//x.y",
+	} {
+		if target := localUrl(returnTo); target != expected {
+			t.Errorf("%q: expected %q, got %q", returnTo, expected, target)
+		}
+	}
+}
+
+func TestLoginReturnTo(t *testing.T) {
+	o := newTestOptions(t)
+	o.LoginPath = "/dev/login"
+	h := log.Middleware(Middleware(o)(http.NotFoundHandler()))
+	_, session := loggedIn(t, o, testAlice)
+	csrf := strings.Repeat("c", 32)
+
+	for _, returnTo := range []string{"/%09/evil.com", "/%0A/evil.com", "%09//evil.com", "//evil.com"} {
+		t.Run(returnTo, func(t *testing.T) {
+			// form login, with return_to decoded from the form
+			form := url.Values{"email": {testAlice}, "password": {"password"}, "csrf_token": {csrf}}
+			body := form.Encode() + "&return_to=" + returnTo
+			req := httptest.NewRequest(http.MethodPost, "/dev/login", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: csrf})
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/" {
+				t.Fatalf("expected redirect to /, got %d %q", rec.Code, rec.Header().Get("Location"))
+			}
+
+			// already logged in, with return_to decoded from the query
+			req = httptest.NewRequest(http.MethodGet, "/dev/login?return_to="+returnTo, nil)
+			req.AddCookie(session)
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/" {
+				t.Fatalf("expected redirect to /, got %d %q", rec.Code, rec.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestLoginLowercasesEmail(t *testing.T) {
+	for name, withUsers := range map[string]bool{"shared hash": false, "users file": true} {
+		t.Run(name, func(t *testing.T) {
+			o := newTestOptions(t)
+			o.LoginPath = "/dev/login"
+			if withUsers {
+				users, err := parseUsers([]byte(testAlice + ":" + o.BcryptHash))
+				if err != nil {
+					t.Fatal(err)
+				}
+				o.Users = &Users{users: users}
+			}
+			h := log.Middleware(Middleware(o)(http.NotFoundHandler()))
+			req := httptest.NewRequest(http.MethodPost, "/dev/login", strings.NewReader(`{"email": " Alice@Test.COM ", "password": "password"}`))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+			}
+			sessions := o.Sessions.List()
+			if len(sessions) != 1 || sessions[0].Email != testAlice {
+				t.Errorf("expected a session of %s, got %+v", testAlice, sessions)
+			}
+		})
+	}
+}
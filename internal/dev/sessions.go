@@ -0,0 +1,235 @@
+package dev
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/modfin/epoxy/internal/filewatch"
+	"github.com/modfin/epoxy/internal/log"
+)
+
+// Session is a dev mode session, identified by the jti of its cookie.
+type Session struct {
+	Id        string    `json:"id"`
+	Email     string    `json:"email"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Sessions keeps track of issued sessions and revocations, persisted to a JSON file if it has a path. Sessions can be
+// revoked by id, or all sessions of a user issued before the revocation.
+type Sessions struct {
+	path     string
+	duration time.Duration // of sessions, revocations of users are pruned after
+
+	mu      sync.RWMutex
+	state   sessionsState
+	written []byte // content of the file as last written or loaded, so reloads of own writes are skipped
+}
+
+type sessionsState struct {
+	Sessions     map[string]Session   `json:"sessions"`      // by id
+	Revoked      map[string]time.Time `json:"revoked"`       // session id to expiry, pruned after
+	RevokedUsers map[string]time.Time `json:"revoked_users"` // email to time of revocation, pruned after the session duration
+}
+
+// NewSessions loads the sessions file at path, created if it does not exist. Sessions are only kept in memory if path
+// is empty. duration is the max duration of a session cookie, after which a revocation of a user has no sessions
+// left to revoke.
+func NewSessions(path string, duration time.Duration) (*Sessions, error) {
+	s := &Sessions{path: path, duration: duration, state: newSessionsState()}
+	if path == "" {
+		return s, nil
+	}
+	err := s.load()
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	return s, err
+}
+
+func newSessionsState() sessionsState {
+	return sessionsState{
+		Sessions:     make(map[string]Session),
+		Revoked:      make(map[string]time.Time),
+		RevokedUsers: make(map[string]time.Time),
+	}
+}
+
+// Watch reloads the sessions file every interval when changed, e.g. to revoke a session by editing it, until ctx is done.
+func (s *Sessions) Watch(ctx context.Context, interval time.Duration) {
+	if s.path == "" {
+		return
+	}
+	filewatch.Watch(ctx, interval, []string{s.path}, func() {
+		err := s.load()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.New().WithError(err).Error("dev: error reloading sessions file, keeping previous")
+		}
+	})
+}
+
+// Add records an issued or renewed session. Renewed sessions keep the issue time recorded when issued, as the iat of
+// the cookie only has seconds precision.
+func (s *Sessions) Add(session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.state.Sessions[session.Id]; ok {
+		session.IssuedAt = existing.IssuedAt
+	}
+	s.state.Sessions[session.Id] = session
+	return s.save()
+}
+
+// Revoke revokes the session with id, until it expires. expires is used for sessions not known, e.g. issued before
+// the sessions file was used.
+func (s *Sessions) Revoke(id string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.state.Sessions[id]; ok {
+		expires = session.ExpiresAt
+		delete(s.state.Sessions, id)
+	}
+	s.state.Revoked[id] = expires
+	return s.save()
+}
+
+// RevokeUser revokes all sessions of the user issued until now.
+func (s *Sessions) RevokeUser(email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	email = strings.ToLower(email)
+	s.state.RevokedUsers[email] = time.Now()
+	for id, session := range s.state.Sessions {
+		if strings.EqualFold(session.Email, email) {
+			delete(s.state.Sessions, id)
+		}
+	}
+	return s.save()
+}
+
+// Revoked reports if the session with id, of email and issued at iat, has been revoked. As iat only has seconds
+// precision, sessions of a revoked user are compared by the issue time recorded by Add if known, otherwise sessions
+// issued in the second of the revocation are revoked too.
+func (s *Sessions) Revoked(id string, email string, iat time.Time) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.state.Revoked[id]; ok {
+		return true
+	}
+	revokedAt, ok := s.state.RevokedUsers[strings.ToLower(email)]
+	if !ok {
+		return false
+	}
+	if session, ok := s.state.Sessions[id]; ok {
+		return !session.IssuedAt.After(revokedAt)
+	}
+	return !iat.After(revokedAt.Truncate(time.Second))
+}
+
+// Get returns the session with id, false if not known or revoked.
+func (s *Sessions) Get(id string) (Session, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, ok := s.state.Sessions[id]
+	return session, ok
+}
+
+// List returns the sessions not expired or revoked, newest first.
+func (s *Sessions) List() []Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Session, 0, len(s.state.Sessions))
+	for _, session := range s.state.Sessions {
+		if time.Now().Before(session.ExpiresAt) {
+			list = append(list, session)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].IssuedAt.After(list[j].IssuedAt)
+	})
+	return list
+}
+
+// load reads the file and replaces the state, unless it is the content last written. Reading and replacing is one
+// critical section, so a concurrent save can't be overwritten by an older read.
+func (s *Sessions) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(b, s.written) {
+		return nil
+	}
+	var state sessionsState
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return err
+	}
+	if state.Sessions == nil {
+		state.Sessions = make(map[string]Session)
+	}
+	if state.Revoked == nil {
+		state.Revoked = make(map[string]time.Time)
+	}
+	if state.RevokedUsers == nil {
+		state.RevokedUsers = make(map[string]time.Time)
+	}
+	s.state = state
+	s.written = b
+	return nil
+}
+
+// save prunes expired sessions and revocations, and writes the file atomically. s.mu must be held.
+func (s *Sessions) save() error {
+	for id, session := range s.state.Sessions {
+		if time.Now().After(session.ExpiresAt) {
+			delete(s.state.Sessions, id)
+		}
+	}
+	for id, expires := range s.state.Revoked {
+		if time.Now().After(expires) {
+			delete(s.state.Revoked, id)
+		}
+	}
+	for email, revokedAt := range s.state.RevokedUsers {
+		if time.Since(revokedAt) > s.duration {
+			delete(s.state.RevokedUsers, email)
+		}
+	}
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".sessions-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		return err
+	}
+	s.written = b
+	return nil
+}
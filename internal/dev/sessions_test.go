@@ -0,0 +1,121 @@
+package dev
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRevokeUser(t *testing.T) {
+	s, _ := NewSessions("", time.Hour)
+	before := time.Now()
+	err := s.Add(Session{Id: "before", Email: "alice@test.com", IssuedAt: before, ExpiresAt: before.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RevokeUser("Alice@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// logged in again within the second of the revocation, iat is truncated to the same second
+	after := time.Now()
+	err = s.Add(Session{Id: "after", Email: "alice@test.com", IssuedAt: after, ExpiresAt: after.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.Revoked("before", "alice@test.com", before.Truncate(time.Second)) {
+		t.Error("expected session issued before the revocation to be revoked")
+	}
+	if s.Revoked("after", "alice@test.com", after.Truncate(time.Second)) {
+		t.Error("expected session issued after the revocation not to be revoked")
+	}
+	if !s.Revoked("unknown", "alice@test.com", after.Truncate(time.Second)) {
+		t.Error("expected unknown session issued in the second of the revocation to be revoked")
+	}
+	if s.Revoked("unknown", "alice@test.com", after.Add(time.Second)) {
+		t.Error("expected unknown session issued after the revocation not to be revoked")
+	}
+	if s.Revoked("other", "bob@test.com", before.Truncate(time.Second)) {
+		t.Error("expected sessions of other users not to be revoked")
+	}
+
+	// renewing keeps the recorded issue time
+	err = s.Add(Session{Id: "after", Email: "alice@test.com", IssuedAt: after.Truncate(time.Second), ExpiresAt: after.Add(2 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Revoked("after", "alice@test.com", after.Truncate(time.Second)) {
+		t.Error("expected renewed session issued after the revocation not to be revoked")
+	}
+}
+
+func TestPruneRevokedUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	s, err := NewSessions(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.state.RevokedUsers["old@test.com"] = time.Now().Add(-2 * time.Hour)
+	err = s.RevokeUser("new@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewSessions(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.state.RevokedUsers["old@test.com"]; ok {
+		t.Error("expected revocation older than the session duration to be pruned")
+	}
+	if _, ok := s.state.RevokedUsers["new@test.com"]; !ok {
+		t.Error("expected recent revocation to be kept")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	s, err := NewSessions(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reloads racing own writes keep every revocation
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = s.Revoke(fmt.Sprintf("session-%d", i), time.Now().Add(time.Hour))
+		}()
+		go func() {
+			defer wg.Done()
+			_ = s.load()
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 20; i++ {
+		if !s.Revoked(fmt.Sprintf("session-%d", i), "alice@test.com", time.Now()) {
+			t.Fatalf("expected session-%d to stay revoked", i)
+		}
+	}
+
+	// edits by others are loaded
+	other, err := NewSessions(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Revoke("edited", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Revoked("edited", "alice@test.com", time.Now()) {
+		t.Fatal("expected edited revocation to be loaded")
+	}
+}
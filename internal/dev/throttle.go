@@ -0,0 +1,122 @@
+package dev
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	freeAttempts = 3           // failed attempts before backing off
+	baseBackoff  = time.Second // doubled for every further failed attempt
+)
+
+// throttle limits failed login attempts per key, e.g. client ip or email. After freeAttempts failures each further
+// attempt has to wait an exponentially growing backoff, and after maxAttempts failures the key is locked out.
+type throttle struct {
+	maxAttempts int
+	lockout     time.Duration
+
+	mu       sync.Mutex
+	attempts map[string]*attempts
+	lastGC   time.Time
+}
+
+type attempts struct {
+	failures        int
+	lastFailure     time.Time
+	blockedTill     time.Time
+	prevBlockedTill time.Time // before the last failure, restored by release
+}
+
+func newThrottle(maxAttempts int, lockout time.Duration) *throttle {
+	return &throttle{
+		maxAttempts: maxAttempts,
+		lockout:     lockout,
+		attempts:    make(map[string]*attempts),
+	}
+}
+
+// attempt reserves an attempt of all keys, checking and recording it in one critical section so concurrent attempts
+// can't pass the backoff of each other. The attempt counts as failed until released with succeed. It returns how long
+// to wait if any key is blocked, without reserving, and otherwise the failures of each key including this attempt and
+// if each key is locked out should it fail.
+func (t *throttle) attempt(keys ...string) (time.Duration, []int, []bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if a, ok := t.attempts[key]; ok {
+			wait = max(wait, time.Until(a.blockedTill))
+		}
+	}
+	if wait > 0 {
+		return wait, nil, nil
+	}
+	t.gc()
+	failures := make([]int, len(keys))
+	locked := make([]bool, len(keys))
+	for i, key := range keys {
+		failures[i], locked[i] = t.fail(key)
+	}
+	return 0, failures, locked
+}
+
+// fail records a failed attempt of key, and returns the number of failures and if the key is now locked out. t.mu
+// must be held.
+func (t *throttle) fail(key string) (int, bool) {
+	a, ok := t.attempts[key]
+	if !ok {
+		a = &attempts{}
+		t.attempts[key] = a
+	}
+	a.failures++
+	a.lastFailure = time.Now()
+	a.prevBlockedTill = a.blockedTill
+	if a.failures >= t.maxAttempts {
+		a.blockedTill = time.Now().Add(t.lockout)
+		return a.failures, true
+	}
+	if a.failures >= freeAttempts {
+		a.blockedTill = time.Now().Add(min(baseBackoff<<min(a.failures-freeAttempts, 20), t.lockout))
+	}
+	return a.failures, false
+}
+
+// release undoes the attempt reserved by attempt for keys, keeping their earlier failures.
+func (t *throttle) release(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, key := range keys {
+		a, ok := t.attempts[key]
+		if !ok {
+			continue
+		}
+		a.failures--
+		a.blockedTill = a.prevBlockedTill
+		if a.failures <= 0 {
+			delete(t.attempts, key)
+		}
+	}
+}
+
+// succeed releases the attempt reserved by attempt for keys, and forgets their failed attempts.
+func (t *throttle) succeed(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, key := range keys {
+		delete(t.attempts, key)
+	}
+}
+
+// gc forgets keys without failures for the lockout duration, at most once a minute. t.mu must be held.
+func (t *throttle) gc() {
+	if time.Since(t.lastGC) < time.Minute {
+		return
+	}
+	t.lastGC = time.Now()
+	for key, a := range t.attempts {
+		if time.Since(a.lastFailure) > t.lockout && time.Now().After(a.blockedTill) {
+			delete(t.attempts, key)
+		}
+	}
+}
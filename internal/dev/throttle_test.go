@@ -0,0 +1,74 @@
+package dev
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThrottleConcurrentAttempts(t *testing.T) {
+	logins := newThrottle(10, time.Minute)
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if wait, _, _ := logins.attempt("ip:127.0.0.1", "email:alice@test.com"); wait == 0 {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := allowed.Load(); n != freeAttempts {
+		t.Fatalf("expected %d concurrent attempts before backing off, got %d", freeAttempts, n)
+	}
+}
+
+func TestThrottleSucceed(t *testing.T) {
+	logins := newThrottle(10, time.Minute)
+	for i := 1; i < freeAttempts; i++ {
+		wait, failures, _ := logins.attempt("email:alice@test.com")
+		if wait > 0 || failures[0] != i {
+			t.Fatalf("expected attempt %d to be allowed, got wait %s and %v failures", i, wait, failures)
+		}
+	}
+	logins.succeed("email:alice@test.com")
+	if _, failures, _ := logins.attempt("email:alice@test.com"); failures[0] != 1 {
+		t.Fatalf("expected failures to be forgotten on success, got %v", failures)
+	}
+}
+
+func TestThrottleLockout(t *testing.T) {
+	logins := newThrottle(freeAttempts, time.Minute)
+	var locked []bool
+	for i := 0; i < freeAttempts; i++ {
+		_, _, locked = logins.attempt("email:alice@test.com")
+	}
+	if !locked[0] {
+		t.Fatal("expected lockout after max attempts")
+	}
+	if wait, _, _ := logins.attempt("email:alice@test.com"); wait < 59*time.Second {
+		t.Fatalf("expected to wait for the lockout, got %s", wait)
+	}
+}
+
+func TestThrottleReleaseKeepsFailures(t *testing.T) {
+	logins := newThrottle(10, time.Minute)
+	logins.attempt("ip:127.0.0.1", "email:mallory@test.com")
+	logins.attempt("ip:127.0.0.1", "email:mallory@test.com")
+
+	// a successful login from the same ip
+	logins.attempt("ip:127.0.0.1", "email:alice@test.com")
+	logins.release("ip:127.0.0.1")
+	logins.succeed("email:alice@test.com")
+
+	_, failures, _ := logins.attempt("ip:127.0.0.1", "email:alice@test.com")
+	if failures[0] != 3 {
+		t.Errorf("expected the earlier failures of the ip to be kept, got %d", failures[0])
+	}
+	if failures[1] != 1 {
+		t.Errorf("expected the failures of the email to be forgotten, got %d", failures[1])
+	}
+}
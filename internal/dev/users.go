@@ -0,0 +1,135 @@
+package dev
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/modfin/epoxy/internal/filewatch"
+	"github.com/modfin/epoxy/internal/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against for unknown users, so they take as long to reject as a wrong password.
+var dummyHash = sync.OnceValue(func() []byte {
+	h, _ := bcrypt.GenerateFromPassword([]byte("epoxy-dev-dummy"), bcrypt.DefaultCost)
+	return h
+})
+
+// Users are the dev mode users of a user file, with one user per line as `email:bcrypt hash[:json claims]` e.g.
+//
+//	alice@test.com:$2y$10$...
+//	bob@test.com:$2y$10$...:{"roles": ["admin"]}
+//
+// Empty lines and lines starting with # are ignored. Emails are case-insensitive and must be unique.
+type Users struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string]user
+}
+
+type user struct {
+	hash   []byte
+	claims map[string]any
+}
+
+// LoadUsers loads the user file at path.
+func LoadUsers(path string) (*Users, error) {
+	u := &Users{path: path}
+	return u, u.load()
+}
+
+// Watch reloads the user file every interval when changed, until ctx is done. The previous users are kept if the file
+// is invalid.
+func (u *Users) Watch(ctx context.Context, interval time.Duration) {
+	filewatch.Watch(ctx, interval, []string{u.path}, func() {
+		err := u.load()
+		if err != nil {
+			log.New().WithError(err).Error("dev: error reloading users file, keeping previous")
+			return
+		}
+		log.New().WithField("users_file", u.path).Info("dev: reloaded users file")
+	})
+}
+
+// Authenticate returns the extra claims of the user if password is correct.
+func (u *Users) Authenticate(email string, password string) (map[string]any, bool) {
+	usr, ok := u.lookup(email)
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return nil, false
+	}
+	if bcrypt.CompareHashAndPassword(usr.hash, []byte(password)) != nil {
+		return nil, false
+	}
+	return usr.claims, true
+}
+
+// Claims returns the extra claims of the user, false if the user is no longer in the file.
+func (u *Users) Claims(email string) (map[string]any, bool) {
+	usr, ok := u.lookup(email)
+	return usr.claims, ok
+}
+
+func (u *Users) lookup(email string) (user, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	usr, ok := u.users[strings.ToLower(strings.TrimSpace(email))]
+	return usr, ok
+}
+
+func (u *Users) load() error {
+	b, err := os.ReadFile(u.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseUsers(b)
+	if err != nil {
+		return fmt.Errorf("dev: %s: %w", u.path, err)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.users = users
+	return nil
+}
+
+func parseUsers(b []byte) (map[string]user, error) {
+	users := make(map[string]user)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	line := 0
+	for scanner.Scan() {
+		line++
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		parts := strings.SplitN(l, ":", 3)
+		if len(parts) < 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("line %d: expected email:bcrypt hash[:json claims]", line)
+		}
+		email := strings.ToLower(strings.TrimSpace(parts[0]))
+		if _, ok := users[email]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user %s", line, email)
+		}
+		hash := []byte(strings.TrimSpace(parts[1]))
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("line %d: invalid bcrypt hash: %w", line, err)
+		}
+		usr := user{hash: hash}
+		if len(parts) == 3 && strings.TrimSpace(parts[2]) != "" {
+			err := json.Unmarshal([]byte(parts[2]), &usr.claims)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid json claims: %w", line, err)
+			}
+		}
+		users[email] = usr
+	}
+	return users, scanner.Err()
+}
@@ -0,0 +1,100 @@
+package dev
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testHash(t *testing.T) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestParseUsers(t *testing.T) {
+	hash := testHash(t)
+	for _, tc := range []struct {
+		name   string
+		file   string
+		users  []string
+		claims map[string]any // of the first user
+		err    string
+	}{
+		{
+			name:  "comments and empty lines",
+			file:  "# users\n\nalice@test.com:%[1]s\n  # bob@test.com:%[1]s\n\t\nbob@test.com:%[1]s\n",
+			users: []string{"alice@test.com", "bob@test.com"},
+		},
+		{
+			name:  "mixed case email",
+			file:  " Alice@Test.COM :%[1]s",
+			users: []string{"alice@test.com"},
+		},
+		{
+			name:   "claims",
+			file:   `alice@test.com:%[1]s:{"roles": ["admin"], "team": "a:b"}`,
+			users:  []string{"alice@test.com"},
+			claims: map[string]any{"roles": []any{"admin"}, "team": "a:b"},
+		},
+		{
+			name:  "empty claims",
+			file:  "alice@test.com:%[1]s: ",
+			users: []string{"alice@test.com"},
+		},
+		{name: "duplicate email", file: "alice@test.com:%[1]s\nalice@test.com:%[1]s", err: "line 2: duplicate user"},
+		{name: "duplicate mixed case email", file: "alice@test.com:%[1]s\nALICE@test.com:%[1]s", err: "line 2: duplicate user"},
+		{name: "invalid hash", file: "# users\nalice@test.com:not-a-hash", err: "line 2: invalid bcrypt hash"},
+		{name: "plain password", file: "alice@test.com:password", err: "line 1: invalid bcrypt hash"},
+		{name: "bad json claims", file: `alice@test.com:%[1]s:{"roles": [}`, err: "line 1: invalid json claims"},
+		{name: "claims not an object", file: `alice@test.com:%[1]s:["admin"]`, err: "line 1: invalid json claims"},
+		{name: "missing hash", file: "alice@test.com", err: "line 1: expected email:bcrypt hash"},
+		{name: "missing email", file: ":%[1]s", err: "line 1: expected email:bcrypt hash"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			users, err := parseUsers([]byte(fmt.Sprintf(tc.file, hash)))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != len(tc.users) {
+				t.Fatalf("expected users %v, got %d", tc.users, len(users))
+			}
+			for _, email := range tc.users {
+				if _, ok := users[email]; !ok {
+					t.Errorf("expected user %s", email)
+				}
+			}
+			if claims := users[tc.users[0]].claims; !reflect.DeepEqual(claims, tc.claims) {
+				t.Errorf("expected claims %v, got %v", tc.claims, claims)
+			}
+		})
+	}
+}
+
+func TestAuthenticateCaseInsensitive(t *testing.T) {
+	users, err := parseUsers([]byte("Alice@Test.com:" + testHash(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &Users{users: users}
+	for _, email := range []string{"alice@test.com", "ALICE@TEST.COM", " Alice@Test.com "} {
+		if _, ok := u.Authenticate(email, "password"); !ok {
+			t.Errorf("%q: expected to authenticate", email)
+		}
+	}
+	if _, ok := u.Authenticate("alice@test.com", "Password"); ok {
+		t.Error("expected passwords to be case-sensitive")
+	}
+}
@@ -1,96 +1,233 @@
 package epoxytoken
 
 import (
-	"crypto/ecdsa"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/modfin/epoxy/internal/dev"
+	"github.com/modfin/epoxy/internal/errorpage"
 	"github.com/modfin/epoxy/internal/extjwt"
+	"github.com/modfin/epoxy/internal/keyset"
 	"github.com/modfin/epoxy/internal/log"
+	"github.com/modfin/epoxy/internal/oidc"
 	"github.com/modfin/epoxy/pkg/epoxy"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 )
 
 type EpoxyClaims struct {
 	jwt.RegisteredClaims
-	ExtClaims jwt.Claims `json:"ext_claims"`
+	SubjectType string     `json:"sub_type,omitempty"` // user, service or dev
+	ExtClaims   jwt.Claims `json:"ext_claims,omitempty"`
+
+	Mapped map[string]any `json:"-"` // top level claims mapped from the identity, see Options.Claims
+}
+
+// MarshalJSON adds the mapped claims at the top level.
+func (c EpoxyClaims) MarshalJSON() ([]byte, error) {
+	type epoxyClaims EpoxyClaims
+	b, err := json.Marshal(epoxyClaims(c))
+	if err != nil || len(c.Mapped) == 0 {
+		return b, err
+	}
+	var m map[string]any
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Mapped {
+		m[k] = v
+	}
+	return json.Marshal(m)
+}
+
+// reservedClaims can't be mapped, as they are set by epoxy.
+var reservedClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti", "sub_type", "ext_claims"}
+
+// Options configures the issued Epoxy-Tokens.
+type Options struct {
+	Keys          *keyset.KeySet
+	Issuer        string                       // default epoxy
+	Ttl           time.Duration                // default 1m
+	Audience      func(r *http.Request) string // aud of the token for r, e.g. of the route it matches, none if empty
+	Claims        map[string]string            // top level claims by dot separated path in the identity, see mapClaims
+	OmitExtClaims bool                         // only pass on mapped claims, not the whole ext_claims
+}
+
+func (o Options) withDefaults() Options {
+	if err := o.validate(); err != nil {
+		log.New().Fatal(err.Error())
+	}
+	if o.Issuer == "" {
+		o.Issuer = "epoxy"
+	}
+	if o.Ttl <= 0 {
+		o.Ttl = time.Minute
+	}
+	return o
+}
+
+func (o Options) validate() error {
+	if o.Keys == nil {
+		return errors.New("epoxytoken: jwt key required")
+	}
+	for name := range o.Claims {
+		if slices.Contains(reservedClaims, name) {
+			return fmt.Errorf("epoxytoken: claim '%s' can't be mapped", name)
+		}
+	}
+	return nil
+}
+
+// mapClaims returns the mapped claims found in id, by path in
+//
+//	{"email": <email>, "claims": <claims of the authenticating token>, "ext": <external jwt claims>}
+//
+// e.g. "claims.email" or "ext.user.groups".
+func (o Options) mapClaims(id *epoxy.Identity) map[string]any {
+	if len(o.Claims) == 0 {
+		return nil
+	}
+	source := map[string]any{"email": id.Email, "claims": id.Claims, "ext": id.Ext}
+	mapped := make(map[string]any)
+	for name, path := range o.Claims {
+		if v := epoxy.LookupClaim(source, path); v != nil && v != "" {
+			mapped[name] = v
+		}
+	}
+	return mapped
+}
+
+// sign completes claims with the registered claims of o and the mapped claims of the identity of r, and sets the
+// signed token as Epoxy-Token header of r.
+func (o Options) sign(r *http.Request, claims EpoxyClaims) error {
+	claims.Issuer = o.Issuer
+	claims.IssuedAt = &jwt.NumericDate{Time: time.Now()}
+	claims.ExpiresAt = &jwt.NumericDate{Time: time.Now().Add(o.Ttl)}
+	if o.Audience != nil {
+		if aud := o.Audience(r); aud != "" {
+			claims.Audience = jwt.ClaimStrings{aud}
+		}
+	}
+	if id, ok := epoxy.IdentityFromContext(r.Context()); ok {
+		claims.Mapped = o.mapClaims(id)
+	}
+	if o.OmitExtClaims {
+		claims.ExtClaims = nil
+	}
+	epoxyJwt, err := o.Keys.Sign(claims)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Epoxy-Token", epoxyJwt)
+	return nil
 }
 
-func MiddlewareExt(epoxyJwtKey *ecdsa.PrivateKey, subjectPath string) epoxy.Middleware {
-	if epoxyJwtKey == nil {
-		log.New().Fatal("epoxytoken: jwt key required")
+func MiddlewareExt(o Options, subjectPath string) epoxy.Middleware {
+	o = o.withDefaults()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var claims EpoxyClaims
+			if id, ok := epoxy.IdentityFromContext(r.Context()); ok && id.Type == epoxy.IdentityService {
+				claims = EpoxyClaims{
+					RegisteredClaims: jwt.RegisteredClaims{Subject: id.CommonName},
+					SubjectType:      epoxy.IdentityService,
+				}
+				if extClaims, err := extjwt.ExtValidationClaims(r.Context()); err == nil {
+					claims.ExtClaims = extClaims
+				}
+			} else {
+				extClaims, err := extjwt.ExtValidationClaims(r.Context())
+				if err != nil {
+					log.New().WithError(fmt.Errorf("epoxytoken: %w", err)).AddToContext(r.Context())
+					errorpage.Write(w, r, http.StatusUnauthorized)
+					return
+				}
+				subject, err := getPath(extClaims, subjectPath)
+				if err != nil {
+					log.New().WithError(fmt.Errorf("epoxytoken: subject not found: %w", err)).AddToContext(r.Context())
+					errorpage.Write(w, r, http.StatusUnauthorized)
+					return
+				}
+				claims = EpoxyClaims{
+					RegisteredClaims: jwt.RegisteredClaims{Subject: subject},
+					SubjectType:      epoxy.IdentityUser,
+					ExtClaims:        extClaims,
+				}
+			}
+			if err := o.sign(r, claims); err != nil {
+				log.New().WithError(err).AddToContext(r.Context())
+				errorpage.Write(w, r, http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
 	}
+}
+
+// MiddlewareOidc issues an Epoxy-Token for the OIDC session, with the subject at subjectPath of the ID token claims.
+func MiddlewareOidc(o Options, subjectPath string) epoxy.Middleware {
+	o = o.withDefaults()
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			extClaims, err := extjwt.ExtValidationClaims(r.Context())
+			oidcClaims, err := oidc.Claims(r.Context())
 			if err != nil {
 				log.New().WithError(fmt.Errorf("epoxytoken: %w", err)).AddToContext(r.Context())
-				w.WriteHeader(http.StatusUnauthorized)
+				errorpage.Write(w, r, http.StatusUnauthorized)
 				return
 			}
-			subject, err := getPath(extClaims, subjectPath)
+			subject, err := getPath(oidcClaims, subjectPath)
 			if err != nil {
 				log.New().WithError(fmt.Errorf("epoxytoken: subject not found: %w", err)).AddToContext(r.Context())
-				w.WriteHeader(http.StatusUnauthorized)
+				errorpage.Write(w, r, http.StatusUnauthorized)
 				return
 			}
 			claims := EpoxyClaims{
-				RegisteredClaims: jwt.RegisteredClaims{
-					Issuer:    "epoxy",
-					Subject:   subject,
-					IssuedAt:  &jwt.NumericDate{Time: time.Now()},
-					ExpiresAt: &jwt.NumericDate{Time: time.Now().Add(time.Minute)},
-				},
-				ExtClaims: extClaims,
+				RegisteredClaims: jwt.RegisteredClaims{Subject: subject},
+				SubjectType:      epoxy.IdentityUser,
+				ExtClaims:        oidcClaims,
 			}
-			epoxyJwt, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(epoxyJwtKey)
-			if err != nil {
+			if err := o.sign(r, claims); err != nil {
 				log.New().WithError(err).AddToContext(r.Context())
-				w.WriteHeader(http.StatusUnauthorized)
+				errorpage.Write(w, r, http.StatusUnauthorized)
 				return
 			}
-			r.Header.Set("Epoxy-Token", epoxyJwt)
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-func MiddlewareDev(epoxyJwtKey *ecdsa.PrivateKey, allowedSuffix string) epoxy.Middleware {
-	if epoxyJwtKey == nil {
-		log.New().Fatal("epoxytoken: jwt key required")
-	}
+func MiddlewareDev(o Options, allowedSuffix string) epoxy.Middleware {
+	o = o.withDefaults()
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			email, err := dev.Email(r.Context())
 			if err != nil {
 				log.New().WithError(fmt.Errorf("epoxytoken: %w", err)).AddToContext(r.Context())
-				w.WriteHeader(http.StatusUnauthorized)
+				errorpage.Write(w, r, http.StatusUnauthorized)
 				return
 			}
-			if !strings.HasSuffix(email, allowedSuffix) || strings.TrimSpace(strings.TrimSuffix(email, allowedSuffix)) == "" {
+			if !dev.AllowedEmail(email, allowedSuffix) {
 				log.New().WithError(errors.New("epoxytoken: dev auth email not allowed")).AddToContext(r.Context())
-				w.WriteHeader(http.StatusUnauthorized)
+				errorpage.Write(w, r, http.StatusUnauthorized)
 				return
 			}
 			claims := EpoxyClaims{
-				RegisteredClaims: jwt.RegisteredClaims{
-					Issuer:    "epoxy",
-					Subject:   email,
-					IssuedAt:  &jwt.NumericDate{Time: time.Now()},
-					ExpiresAt: &jwt.NumericDate{Time: time.Now().Add(time.Minute)},
-				},
+				RegisteredClaims: jwt.RegisteredClaims{Subject: email},
+				SubjectType:      epoxy.IdentityDev,
 			}
-			epoxyJwt, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(epoxyJwtKey)
-			if err != nil {
+			// extra claims of the user in the dev users file
+			if id, ok := epoxy.IdentityFromContext(r.Context()); ok && len(id.Claims) > 0 {
+				claims.ExtClaims = jwt.MapClaims(id.Claims)
+			}
+			if err := o.sign(r, claims); err != nil {
 				log.New().WithError(err).AddToContext(r.Context())
-				w.WriteHeader(http.StatusUnauthorized)
+				errorpage.Write(w, r, http.StatusUnauthorized)
 				return
 			}
-			r.Header.Set("Epoxy-Token", epoxyJwt)
 			next.ServeHTTP(w, r)
 		})
 	}
@@ -0,0 +1,145 @@
+package epoxytoken
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/modfin/epoxy/internal/keyset"
+	"github.com/modfin/epoxy/pkg/epoxy"
+)
+
+func newKeys(t *testing.T) *keyset.KeySet {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keyset.New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// signed signs claims for r and returns the claims of the issued Epoxy-Token.
+func signed(t *testing.T, o Options, r *http.Request, claims EpoxyClaims) jwt.MapClaims {
+	t.Helper()
+	if err := o.withDefaults().sign(r, claims); err != nil {
+		t.Fatal(err)
+	}
+	var parsed jwt.MapClaims
+	if _, err := jwt.ParseWithClaims(r.Header.Get("Epoxy-Token"), &parsed, o.Keys.Keyfunc); err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestMarshalJSON(t *testing.T) {
+	b, err := json.Marshal(EpoxyClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "alice@example.com"},
+		SubjectType:      epoxy.IdentityUser,
+		Mapped:           map[string]any{"email": "alice@example.com", "groups": []string{"dev"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]any{"sub": "alice@example.com", "sub_type": "user", "email": "alice@example.com", "groups": []any{"dev"}}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected claims %v, got %s", expected, b)
+	}
+}
+
+func TestReservedClaims(t *testing.T) {
+	keys := newKeys(t)
+	for _, name := range reservedClaims {
+		if err := (Options{Keys: keys, Claims: map[string]string{name: "email"}}).validate(); err == nil {
+			t.Errorf("%s: expected reserved claim to be rejected", name)
+		}
+	}
+	if err := (Options{Keys: keys, Claims: map[string]string{"email": "email", "groups": "ext.groups"}}).validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (Options{}).validate(); err == nil {
+		t.Error("expected key to be required")
+	}
+}
+
+func TestMappedClaims(t *testing.T) {
+	id := &epoxy.Identity{
+		Type:   epoxy.IdentityUser,
+		Email:  "alice@example.com",
+		Claims: map[string]any{"country": "SE"},
+		Ext:    map[string]any{"user": map[string]any{"groups": []any{"dev", "ops"}}, "empty": ""},
+	}
+	ext := jwt.MapClaims{"user": map[string]any{"groups": []any{"dev", "ops"}}}
+	for _, omit := range []bool{false, true} {
+		o := Options{
+			Keys:          newKeys(t),
+			Claims:        map[string]string{"email": "email", "country": "claims.country", "groups": "ext.user.groups", "missing": "ext.missing", "empty": "ext.empty"},
+			OmitExtClaims: omit,
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = r.WithContext(epoxy.WithIdentity(r.Context(), id))
+		claims := signed(t, o, r, EpoxyClaims{RegisteredClaims: jwt.RegisteredClaims{Subject: id.Email}, ExtClaims: ext})
+
+		if claims["email"] != "alice@example.com" || claims["country"] != "SE" {
+			t.Errorf("omit %t: expected mapped claims at the top level, got %v", omit, claims)
+		}
+		if groups, _ := claims["groups"].([]any); !slices.Equal(groups, []any{"dev", "ops"}) {
+			t.Errorf("omit %t: expected mapped groups, got %v", omit, claims["groups"])
+		}
+		if _, ok := claims["missing"]; ok {
+			t.Errorf("omit %t: expected missing claim to be left out", omit)
+		}
+		if _, ok := claims["empty"]; ok {
+			t.Errorf("omit %t: expected empty claim to be left out", omit)
+		}
+		if _, ok := claims["ext_claims"]; ok == omit {
+			t.Errorf("omit %t: expected ext_claims present %t, got %v", omit, !omit, claims["ext_claims"])
+		}
+	}
+}
+
+func TestRouteAudience(t *testing.T) {
+	e, err := epoxy.NewWithSites(nil,
+		epoxy.Route{Prefix: "/a", Target: "http://127.0.0.1:1", TokenAudience: "service-a"},
+		epoxy.Route{Prefix: "/b", Target: "http://127.0.0.1:1"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := Options{
+		Keys: newKeys(t),
+		Audience: func(r *http.Request) string {
+			route, _ := epoxy.MatchRoute(e, r)
+			return route.TokenAudience
+		},
+	}
+	for path, expected := range map[string][]string{
+		"/a":     {"service-a"},
+		"/a/x":   {"service-a"},
+		"/b/x":   nil,
+		"/other": nil,
+	} {
+		claims := signed(t, o, httptest.NewRequest(http.MethodGet, path, nil), EpoxyClaims{})
+		aud, err := claims.GetAudience()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(aud, expected) {
+			t.Errorf("%s: expected aud %v, got %v", path, expected, aud)
+		}
+	}
+}
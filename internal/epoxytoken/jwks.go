@@ -0,0 +1,41 @@
+package epoxytoken
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"net/http"
+
+	"github.com/modfin/epoxy/internal/log"
+	"github.com/modfin/epoxy/pkg/jwk"
+)
+
+// JwksMiddleware serves the public keys used to verify Epoxy-Token as a JWKS document at path, without requiring
+// authentication. An empty path disables it.
+func JwksMiddleware(path string, keys ...*ecdsa.PublicKey) func(next http.Handler) http.Handler {
+	var set jwk.KeySet
+	for _, k := range keys {
+		key, err := jwk.FromECPublicKey(k)
+		if err != nil {
+			log.New().WithError(err).Fatal("epoxytoken: invalid jwks key")
+		}
+		set.Keys = append(set.Keys, key)
+	}
+	body, err := json.Marshal(set)
+	if err != nil {
+		log.New().WithError(err).Fatal("epoxytoken: error marshalling jwks")
+	}
+	return func(next http.Handler) http.Handler {
+		if path == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != path {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "public, max-age=300")
+			_, _ = w.Write(body)
+		})
+	}
+}
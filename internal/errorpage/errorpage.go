@@ -0,0 +1,204 @@
+package errorpage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/modfin/epoxy/internal/log"
+)
+
+type contextKey struct{}
+
+// Data is passed to error page templates.
+type Data struct {
+	Status     int
+	StatusText string
+	RequestId  string
+}
+
+type template interface {
+	Execute(w io.Writer, data any) error
+}
+
+// Pages holds error templates, looked up by status code ("404"), status class ("4xx") and finally "default".
+type Pages struct {
+	html map[string]template
+	json map[string]template
+}
+
+var defaultPages = &Pages{
+	html: map[string]template{"default": htmltemplate.Must(htmltemplate.New("default").Parse(defaultHtml))},
+	json: map[string]template{"default": texttemplate.Must(texttemplate.New("default").Funcs(jsonFuncs).Parse(defaultJson))},
+}
+
+var jsonFuncs = texttemplate.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// Load reads templates named <name>.html and <name>.json from dir, where name is a status code, a status class
+// or "default". Templates not found in dir fall back to the built-in ones.
+func Load(dir string) (*Pages, error) {
+	p := &Pages{
+		html: make(map[string]template),
+		json: make(map[string]template),
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+		b, err := fs.ReadFile(os.DirFS(dir), e.Name())
+		if err != nil {
+			return nil, err
+		}
+		switch filepath.Ext(e.Name()) {
+		case ".html":
+			t, err := htmltemplate.New(name).Parse(string(b))
+			if err != nil {
+				return nil, err
+			}
+			p.html[name] = t
+		case ".json":
+			t, err := texttemplate.New(name).Funcs(jsonFuncs).Parse(string(b))
+			if err != nil {
+				return nil, err
+			}
+			p.json[name] = t
+		}
+	}
+	if len(p.html) == 0 && len(p.json) == 0 {
+		return nil, errors.New("no .html or .json templates found")
+	}
+	return p, nil
+}
+
+// Middleware makes pages available to Write for all requests passing through it, nil pages uses the built-in ones.
+func Middleware(pages *Pages) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if pages == nil {
+			return next
+		}
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, pages)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// Write answers the request with status and an error body, as JSON if preferred by the Accept header or else as HTML.
+func Write(w http.ResponseWriter, r *http.Request, status int) {
+	pages, ok := r.Context().Value(contextKey{}).(*Pages)
+	if !ok {
+		pages = defaultPages
+	}
+	data := Data{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		RequestId:  r.Header.Get("X-Request-Id"),
+	}
+
+	contentType := "text/html; charset=utf-8"
+	templates, fallback := pages.html, defaultPages.html
+	if prefersJson(r.Header.Get("Accept")) {
+		contentType = "application/json"
+		templates, fallback = pages.json, defaultPages.json
+	}
+	t := lookup(templates, status)
+	if t == nil {
+		t = lookup(fallback, status)
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		log.New().WithError(err).Error("errorpage: error executing template")
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_, _ = buf.WriteTo(w)
+	}
+}
+
+func lookup(templates map[string]template, status int) template {
+	code := strconv.Itoa(status)
+	for _, name := range []string{code, code[:1] + "xx", "default"} {
+		if t, ok := templates[name]; ok {
+			return t
+		}
+	}
+	return nil
+}
+
+// prefersJson reports if JSON is given a higher quality than HTML in an Accept header.
+func prefersJson(accept string) bool {
+	var htmlQ, jsonQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch {
+		case mediaType == "text/html":
+			htmlQ = max(htmlQ, q)
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return jsonQ > htmlQ
+}
+
+const defaultJson = `{"status":{{.Status}},"error":{{json .StatusText}}{{if .RequestId}},"request_id":{{json .RequestId}}{{end}}}
+`
+
+const defaultHtml = `<!doctype html>
+<html>
+<head>
+   <meta name="viewport" content="width=device-width, initial-scale=1.0">
+   <title>{{.Status}} {{.StatusText}}</title>
+</head>
+<body>
+	<main>
+		<h1>{{.Status}}</h1>
+		<p>{{.StatusText}}</p>
+		{{if .RequestId}}<p><small>Request id: {{.RequestId}}</small></p>{{end}}
+	</main>
+</body>
+</html>
+<style>
+main {
+	margin-top: 100px;
+	margin-left: auto;
+	margin-right: auto;
+	width: 250px;
+	font-family: sans-serif;
+	text-align: center;
+}
+</style>
+`
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/modfin/epoxy/internal/cf"
+	"github.com/modfin/epoxy/internal/errorpage"
 	"github.com/modfin/epoxy/internal/log"
 	"github.com/modfin/epoxy/internal/simplecache"
 	"github.com/modfin/epoxy/pkg/epoxy"
@@ -18,28 +19,38 @@ import (
 
 type contextKey struct{}
 
-func Middleware(extJwkUrl string, extJwtUrl string) epoxy.Middleware {
+// Middleware fetches the external JWT for the Cloudflare token of the request. Requests authenticated with a service
+// token are passed on without external claims, unless fetchForServiceTokens is set. The key set of extJwkUrl is kept
+// refreshed until ctx is done, and the external JWT is validated with opts.
+func Middleware(ctx context.Context, extJwkUrl string, extJwtUrl string, fetchForServiceTokens bool, opts ...jwk.Option) epoxy.Middleware {
 	if extJwkUrl == "" || extJwtUrl == "" {
 		log.New().Fatal("extjwt: missing required parameters")
 	}
 	return func(next http.Handler) http.Handler {
 
-		jwkCache := simplecache.New(time.Minute * 30)
+		keys := jwk.NewProvider(ctx, extJwkUrl)
 		extJwtCache := simplecache.New(time.Minute * 30)
 
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if id, ok := epoxy.IdentityFromContext(r.Context()); ok && id.Type == epoxy.IdentityService && !fetchForServiceTokens {
+				next.ServeHTTP(w, r)
+				return
+			}
 			cfAuth, err := cf.AccessToken(r.Context())
 			if err != nil {
 				log.New().WithError(err).AddToContext(r.Context())
-				w.WriteHeader(http.StatusInternalServerError)
+				errorpage.Write(w, r, http.StatusInternalServerError)
 				return
 			}
-			extJwt, err := getAndParseExtJwt(r.Context(), jwkCache, extJwtCache, extJwkUrl, extJwtUrl, cfAuth.Raw)
+			extJwt, err := getAndParseExtJwt(r.Context(), keys, extJwtCache, extJwtUrl, cfAuth.Raw, opts)
 			if err != nil {
 				log.New().WithError(fmt.Errorf("extjwt: error getting and parsing token: %w", err)).AddToContext(r.Context())
-				w.WriteHeader(http.StatusUnauthorized)
+				errorpage.Write(w, r, http.StatusUnauthorized)
 				return
 			}
+			if id, ok := epoxy.IdentityFromContext(r.Context()); ok {
+				id.Ext, _ = extJwt.Claims.(jwt.MapClaims)
+			}
 			ctx := context.WithValue(r.Context(), contextKey{}, extJwt.Claims)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
@@ -53,10 +64,10 @@ func ExtValidationClaims(ctx context.Context) (jwt.MapClaims, error) {
 	return nil, errors.New("couldn't get external validation claims, make sure extjwt.Middleware has run")
 }
 
-func getAndParseExtJwt(ctx context.Context, jwkCache simplecache.Cache, jwtCache simplecache.Cache, extJwkUrl string, extJwtUrl string, cfAuthRaw string) (*jwt.Token, error) {
+func getAndParseExtJwt(ctx context.Context, keys *jwk.Provider, jwtCache simplecache.Cache, extJwtUrl string, cfAuthRaw string, opts []jwk.Option) (*jwt.Token, error) {
 	extJwtRaw := jwtCache.Get(cfAuthRaw)
 	if extJwtRaw != "" {
-		extJwt, err := jwk.ParseWithUrl(ctx, jwkCache, extJwkUrl, extJwtRaw)
+		extJwt, err := keys.Parse(extJwtRaw, nil, opts...)
 		if err == nil {
 			return extJwt, nil
 		}
@@ -67,7 +78,7 @@ func getAndParseExtJwt(ctx context.Context, jwkCache simplecache.Cache, jwtCache
 	}
 	jwtCache.Set(cfAuthRaw, extJwtRaw)
 
-	return jwk.ParseWithUrl(ctx, jwkCache, extJwkUrl, extJwtRaw)
+	return keys.Parse(extJwtRaw, nil, opts...)
 }
 
 func getExtJwt(ctx context.Context, cfJwtToken, extJwtUrl string) (string, error) {
@@ -0,0 +1,51 @@
+package filewatch
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Watch polls files every interval until ctx is done, calling onChange when any of them has been modified,
+// created or removed since the previous poll.
+func Watch(ctx context.Context, interval time.Duration, files []string, onChange func()) {
+	last := stat(files)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := stat(files)
+		changed := false
+		for i := range current {
+			if current[i] != last[i] {
+				changed = true
+			}
+		}
+		last = current
+		if changed {
+			onChange()
+		}
+	}
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+func stat(files []string) []fileState {
+	states := make([]fileState, len(files))
+	for i, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		states[i] = fileState{modTime: info.ModTime(), size: info.Size(), exists: true}
+	}
+	return states
+}
@@ -0,0 +1,75 @@
+package forwardauth
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/modfin/epoxy/internal/errorpage"
+	"github.com/modfin/epoxy/internal/log"
+	"github.com/modfin/epoxy/pkg/epoxy"
+)
+
+// Forwarded makes the request look like the one being authenticated, from the X-Forwarded-Host, X-Forwarded-Uri and
+// X-Forwarded-Method headers set by the proxy asking, e.g. nginx auth_request or Traefik ForwardAuth.
+func Forwarded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+			r.Host = host
+		}
+		if uri := r.Header.Get("X-Forwarded-Uri"); uri != "" {
+			u, err := url.ParseRequestURI(uri)
+			if err != nil {
+				log.New().WithError(err).AddToContext(r.Context())
+				errorpage.Write(w, r, http.StatusBadRequest)
+				return
+			}
+			r.URL.Path = cleanPath(u.Path)
+			r.URL.RawPath = ""
+			if r.URL.Path == u.Path {
+				r.URL.RawPath = u.RawPath
+			}
+			r.URL.RawQuery = u.RawQuery
+			r.RequestURI = r.URL.RequestURI()
+		}
+		if method := r.Header.Get("X-Forwarded-Method"); method != "" {
+			r.Method = strings.ToUpper(method)
+		}
+		log.New().
+			WithField("forwarded_host", r.Host).
+			WithField("forwarded_uri", r.URL.RequestURI()).
+			AddToContext(r.Context())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cleanPath resolves dot segments and repeated slashes, keeping a trailing slash, so the path matches the route it is
+// served by rather than a redirect of the mux.
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// Middleware answers authenticated requests instead of proxying them, with 403 if the policy of the route matching the
+// request denies access, or 200 with the identity headers set by the authenticating middlewares.
+func Middleware(e epoxy.Epoxy) epoxy.Middleware {
+	return func(_ http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := e.Authorize(r); err != nil {
+				log.New().WithField("access_denied", err.Error()).AddToContext(r.Context())
+				errorpage.Write(w, r, http.StatusForbidden)
+				return
+			}
+			for _, h := range []string{"Epoxy-Token", "Cf-Access-Authenticated-User-Email"} {
+				if v := r.Header.Get(h); v != "" {
+					w.Header().Set(h, v)
+				}
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+}
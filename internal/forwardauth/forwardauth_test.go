@@ -0,0 +1,109 @@
+package forwardauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/modfin/epoxy/internal/log"
+	"github.com/modfin/epoxy/pkg/epoxy"
+)
+
+const adminEmail = "admin@example.com"
+
+func newEpoxy(t *testing.T) epoxy.Epoxy {
+	t.Helper()
+	e, err := epoxy.NewWithSites(nil,
+		epoxy.Route{Prefix: "/admin", Target: "http://127.0.0.1:1", Access: []epoxy.AccessRule{{Emails: []string{adminEmail}}}},
+		epoxy.Route{Prefix: "/public", Target: "http://127.0.0.1:1"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// newServer answers forward auth requests of the user with email.
+func newServer(t *testing.T, email string) http.Handler {
+	authenticated := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := epoxy.WithIdentity(r.Context(), &epoxy.Identity{Type: epoxy.IdentityUser, Email: email})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+	return log.Middleware(Forwarded(authenticated(Middleware(newEpoxy(t))(nil))))
+}
+
+func forwardAuth(h http.Handler, uri string) int {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-Host", "app.example.com")
+	req.Header.Set("X-Forwarded-Uri", uri)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestAccess(t *testing.T) {
+	user := newServer(t, "user@example.com")
+	admin := newServer(t, adminEmail)
+	for _, tc := range []struct {
+		uri   string
+		user  int
+		admin int
+	}{
+		{uri: "/admin/x", user: http.StatusForbidden, admin: http.StatusOK},
+		{uri: "/admin", user: http.StatusForbidden, admin: http.StatusOK},
+		{uri: "/admin/?q=1", user: http.StatusForbidden, admin: http.StatusOK},
+		{uri: "/admin/./x", user: http.StatusForbidden, admin: http.StatusOK},
+		{uri: "/admin//x", user: http.StatusForbidden, admin: http.StatusOK},
+		{uri: "//admin/x", user: http.StatusForbidden, admin: http.StatusOK},
+		{uri: "/public/../admin/x", user: http.StatusForbidden, admin: http.StatusOK},
+		{uri: "/public/./../admin/", user: http.StatusForbidden, admin: http.StatusOK},
+		{uri: "/%61dmin/x", user: http.StatusForbidden, admin: http.StatusOK},
+		{uri: "/public/x", user: http.StatusOK, admin: http.StatusOK},
+		{uri: "/public//x", user: http.StatusOK, admin: http.StatusOK},
+		{uri: "/other", user: http.StatusOK, admin: http.StatusOK},
+	} {
+		t.Run(tc.uri, func(t *testing.T) {
+			if status := forwardAuth(user, tc.uri); status != tc.user {
+				t.Errorf("user: expected %d, got %d", tc.user, status)
+			}
+			if status := forwardAuth(admin, tc.uri); status != tc.admin {
+				t.Errorf("admin: expected %d, got %d", tc.admin, status)
+			}
+		})
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	for p, expected := range map[string]string{
+		"":                   "/",
+		"/":                  "/",
+		"//":                 "/",
+		"/admin/./x":         "/admin/x",
+		"/admin//x":          "/admin/x",
+		"//admin/x":          "/admin/x",
+		"/public/../admin/x": "/admin/x",
+		"/../admin":          "/admin",
+		"/admin/":            "/admin/",
+		"/admin/x/..":        "/admin",
+	} {
+		if cleaned := cleanPath(p); cleaned != expected {
+			t.Errorf("%q: expected %q, got %q", p, expected, cleaned)
+		}
+	}
+}
+
+// TestAuthorizeUncleanPath checks Authorize on its own denies paths the mux would redirect, for users of epoxy.Epoxy
+// that don't clean the path first.
+func TestAuthorizeUncleanPath(t *testing.T) {
+	e := newEpoxy(t)
+	for _, p := range []string{"/admin/./x", "/admin//x", "//admin/x", "/public/../admin/x"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL.Path = p
+		ctx := epoxy.WithIdentity(req.Context(), &epoxy.Identity{Type: epoxy.IdentityUser, Email: "user@example.com"})
+		if err := e.Authorize(req.WithContext(ctx)); err == nil {
+			t.Errorf("%s: expected access denied", p)
+		}
+	}
+}
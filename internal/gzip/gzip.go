@@ -0,0 +1,31 @@
+package gzip
+
+import (
+	"net/http"
+
+	"github.com/klauspost/compress/gzhttp"
+	"github.com/modfin/epoxy/pkg/epoxy"
+)
+
+// wrapper compresses like gzhttp by default, except streamed responses e.g. Server-Sent Events.
+var wrapper = func() func(http.Handler) http.HandlerFunc {
+	w, err := gzhttp.NewWrapper(gzhttp.ContentTypeFilter(func(ct string) bool {
+		return gzhttp.DefaultContentTypeFilter(ct) && !epoxy.IsStreamingContentType(ct)
+	}))
+	if err != nil {
+		panic(err)
+	}
+	return w
+}()
+
+// Middleware gzip compresses responses, passing streaming requests and responses through unbuffered.
+func Middleware(next http.Handler) http.Handler {
+	gz := wrapper(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if epoxy.IsStreaming(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gz.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,129 @@
+package gzip
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streaming writes a first event with contentType, and the rest only after release is closed.
+func streaming(contentType string, release chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write([]byte("data: 1\n\n"))
+		_ = http.NewResponseController(w).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		_, _ = w.Write([]byte(strings.Repeat("data: 2\n\n", 1000)))
+	})
+}
+
+func get(t *testing.T, server *httptest.Server, accept string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	// raw responses, without transparent decompression
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func TestCompresses(t *testing.T) {
+	server := httptest.NewServer(Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(strings.Repeat("hello ", 1000)))
+	})))
+	defer server.Close()
+
+	resp := get(t, server, "")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip, got %q", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestSkipsServerSentEvents(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		accept string
+	}{
+		{name: "requested", accept: "text/event-stream"},
+		{name: "upstream content type", accept: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			release := make(chan struct{})
+			server := httptest.NewServer(Middleware(streaming("text/event-stream", release)))
+			defer server.Close()
+			defer close(release)
+
+			resp := get(t, server, tc.accept)
+			if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+				t.Fatalf("expected no compression, got %q", enc)
+			}
+			lines := make(chan string, 1)
+			go func() {
+				line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+				lines <- line
+			}()
+			select {
+			case line := <-lines:
+				if line != "data: 1\n" {
+					t.Fatalf("unexpected first event %q", line)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("first event not flushed")
+			}
+		})
+	}
+}
+
+func TestSkipsUpgrade(t *testing.T) {
+	server := httptest.NewServer(Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\nhello")
+		_ = brw.Flush()
+	})))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\nAccept-Encoding: gzip\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("expected uncompressed 101, got %d %q", resp.StatusCode, resp.Header.Get("Content-Encoding"))
+	}
+	b := make([]byte, 5)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "hello" {
+		t.Fatalf("expected raw upgraded data, got %q %v", b, err)
+	}
+}
@@ -0,0 +1,170 @@
+package keyset
+
+import (
+	"crypto/ecdsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/modfin/epoxy/pkg/jwk"
+)
+
+// KeySet holds the active ES256 signing key and additional verify-only keys, identified by kid (the RFC 7638
+// thumbprint of the public key), so keys can be rolled with overlap.
+type KeySet struct {
+	active    *ecdsa.PrivateKey
+	activeKid string
+	kids      []string
+	keys      map[string]*ecdsa.PublicKey
+}
+
+// New creates a key set signing with active and verifying with active and all verify keys.
+func New(active *ecdsa.PrivateKey, verify ...*ecdsa.PublicKey) (*KeySet, error) {
+	if active == nil {
+		return nil, errors.New("keyset: active key required")
+	}
+	k := &KeySet{
+		active: active,
+		keys:   make(map[string]*ecdsa.PublicKey),
+	}
+	kid, err := k.add(&active.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	k.activeKid = kid
+	for _, v := range verify {
+		if _, err := k.add(v); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+func (k *KeySet) add(key *ecdsa.PublicKey) (string, error) {
+	kid, err := jwk.Thumbprint(key)
+	if err != nil {
+		return "", fmt.Errorf("keyset: %w", err)
+	}
+	if _, ok := k.keys[kid]; !ok {
+		k.keys[kid] = key
+		k.kids = append(k.kids, kid)
+	}
+	return kid, nil
+}
+
+// LoadDir loads all .pem files in dir, each containing one or more EC private or public keys. The private key in the
+// file named active (without extension) is used for signing, all other keys are verify-only. If active is empty, dir
+// must contain exactly one private key.
+func LoadDir(dir string, active string, verify ...*ecdsa.PublicKey) (*KeySet, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	var signing *ecdsa.PrivateKey
+	var privateKeys int
+	var verifyOnly []*ecdsa.PublicKey
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		privs, pubs, err := ParsePEM(b)
+		if err != nil {
+			return nil, fmt.Errorf("keyset: %s: %w", f, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+		for _, p := range privs {
+			privateKeys++
+			if signing == nil && (active == "" || name == active) {
+				signing = p
+				continue
+			}
+			verifyOnly = append(verifyOnly, &p.PublicKey)
+		}
+		verifyOnly = append(verifyOnly, pubs...)
+	}
+	if active == "" && privateKeys > 1 {
+		return nil, errors.New("keyset: several private keys found, active key must be specified")
+	}
+	if signing == nil {
+		return nil, fmt.Errorf("keyset: no active private key found in '%s'", dir)
+	}
+	return New(signing, append(verifyOnly, verify...)...)
+}
+
+// ParsePEM parses all EC private and public keys in PEM encoded b.
+func ParsePEM(b []byte) ([]*ecdsa.PrivateKey, []*ecdsa.PublicKey, error) {
+	var privs []*ecdsa.PrivateKey
+	var pubs []*ecdsa.PublicKey
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		encoded := pem.EncodeToMemory(block)
+		switch {
+		case strings.Contains(block.Type, "PRIVATE KEY"):
+			key, err := jwt.ParseECPrivateKeyFromPEM(encoded)
+			if err != nil {
+				return nil, nil, err
+			}
+			privs = append(privs, key)
+		case strings.Contains(block.Type, "PUBLIC KEY"):
+			key, err := jwt.ParseECPublicKeyFromPEM(encoded)
+			if err != nil {
+				return nil, nil, err
+			}
+			pubs = append(pubs, key)
+		}
+	}
+	if len(privs) == 0 && len(pubs) == 0 {
+		return nil, nil, errors.New("no keys found")
+	}
+	return privs, pubs, nil
+}
+
+// Sign signs claims with the active key, setting kid in the token header.
+func (k *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = k.activeKid
+	return token.SignedString(k.active)
+}
+
+// Keyfunc resolves the verification key of an ES256 token by kid, tokens without kid are tried against all keys.
+func (k *KeySet) Keyfunc(t *jwt.Token) (interface{}, error) {
+	if t.Method.Alg() != jwt.SigningMethodES256.Alg() {
+		return nil, fmt.Errorf("unexpected jwt signing method=%v", t.Header["alg"])
+	}
+	kid, ok := t.Header["kid"].(string)
+	if !ok {
+		var set jwt.VerificationKeySet
+		for _, key := range k.PublicKeys() {
+			set.Keys = append(set.Keys, key)
+		}
+		return set, nil
+	}
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid '%s'", kid)
+	}
+	return key, nil
+}
+
+// PublicKeys returns the public keys of the set, active key first.
+func (k *KeySet) PublicKeys() []*ecdsa.PublicKey {
+	var keys []*ecdsa.PublicKey
+	for _, kid := range k.kids {
+		keys = append(keys, k.keys[kid])
+	}
+	return keys
+}
+
+// ActiveKid returns the kid of the signing key.
+func (k *KeySet) ActiveKid() string {
+	return k.activeKid
+}
@@ -0,0 +1,11 @@
+package localhost
+
+import "net"
+
+// Is reports if host, with or without port, is localhost, where cookies may be sent without TLS during development.
+func Is(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host == "localhost"
+}
@@ -49,7 +49,8 @@ func (e *event) Fatal(msg string) {
 	e.msg = msg
 	e.level = "error"
 	send(e)
-	ctx, _ := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
 	Drain(ctx)
 	os.Exit(1)
 }
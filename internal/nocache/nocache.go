@@ -2,10 +2,16 @@ package nocache
 
 import (
 	"net/http"
+
+	"github.com/modfin/epoxy/pkg/epoxy"
 )
 
 func Middleware(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
+		if epoxy.IsUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
 		w.Header().Set("Cache-Control", "no-cache")
 		next.ServeHTTP(w, r)
 	}
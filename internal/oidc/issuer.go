@@ -0,0 +1,129 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/modfin/epoxy/pkg/jwk"
+)
+
+// discovery is the subset of the OpenID Provider metadata used.
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint,omitempty"`
+}
+
+// tokenResponse is the response of the token endpoint, for both the authorization code and refresh token grants.
+type tokenResponse struct {
+	IdToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+	ErrorDesc    string `json:"error_description"`
+}
+
+// issuer lazily discovers the metadata of the issuer, so epoxy starts even if the issuer is unavailable.
+type issuer struct {
+	ctx    context.Context
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      *jwk.Provider
+}
+
+// discover returns the metadata and keys of the issuer, fetching the metadata until it succeeds once. The fetch is
+// done without holding the lock, so a slow issuer only delays the requests waiting for it, and a canceled request
+// only fails itself.
+func (i *issuer) discover(ctx context.Context) (*discovery, *jwk.Provider, error) {
+	i.mu.Lock()
+	d, keys := i.discovery, i.keys
+	i.mu.Unlock()
+	if d != nil {
+		return d, keys, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(i.url, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	d = &discovery{}
+	err = i.do(req, d)
+	if err != nil {
+		return nil, nil, fmt.Errorf("oidc: discovery failed: %w", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != strings.TrimSuffix(i.url, "/") {
+		return nil, nil, fmt.Errorf("oidc: discovered issuer '%s' not matching '%s'", d.Issuer, i.url)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksUri == "" {
+		return nil, nil, fmt.Errorf("oidc: discovery of '%s' incomplete", i.url)
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	// another request may have discovered the issuer meanwhile, keep its key provider instead of starting another
+	if i.discovery == nil {
+		i.discovery = d
+		i.keys = jwk.NewProvider(i.ctx, d.JwksUri)
+	}
+	return i.discovery, i.keys, nil
+}
+
+// token calls the token endpoint with the grant in form, authenticating with the client secret if set.
+func (i *issuer) token(ctx context.Context, d *discovery, clientId string, clientSecret string, form url.Values) (*tokenResponse, error) {
+	if clientSecret == "" {
+		form.Set("client_id", clientId)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(clientId), url.QueryEscape(clientSecret))
+	}
+	var t tokenResponse
+	err = i.do(req, &t)
+	if t.Error != "" {
+		return nil, fmt.Errorf("oidc: token endpoint: %s %s", t.Error, t.ErrorDesc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token endpoint: %w", err)
+	}
+	return &t, nil
+}
+
+func (i *issuer) do(req *http.Request, v any) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	// error responses of the token endpoint are json too
+	jsonErr := json.Unmarshal(b, v)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status: %d", resp.StatusCode)
+	}
+	return jsonErr
+}
+
+func expiresIn(seconds int, fallback time.Duration) time.Time {
+	if seconds <= 0 {
+		return time.Now().Add(fallback)
+	}
+	return time.Now().Add(time.Duration(seconds) * time.Second)
+}
@@ -0,0 +1,407 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/modfin/epoxy/internal/errorpage"
+	"github.com/modfin/epoxy/internal/localhost"
+	"github.com/modfin/epoxy/internal/log"
+	"github.com/modfin/epoxy/pkg/epoxy"
+	"github.com/modfin/epoxy/pkg/jwk"
+)
+
+type contextKey struct{}
+
+const (
+	cookieName      = "epoxy-oidc"
+	stateCookieName = "epoxy-oidc-state"
+	stateDuration   = 10 * time.Minute
+)
+
+// Options configures the OpenID Connect relying party.
+type Options struct {
+	Issuer          string        // e.g. https://accounts.example.com, discovered at <issuer>/.well-known/openid-configuration
+	ClientId        string        // of epoxy, registered at the issuer
+	ClientSecret    string        // optional for public clients, the code flow is always protected with PKCE
+	RedirectUrl     string        // callback registered at the issuer e.g. https://app.example.com/oidc/callback
+	Scopes          []string      // default openid, email and profile
+	SessionKey      []byte        // 32 byte AES-256 key encrypting the session cookie
+	SessionDuration time.Duration // max session duration, regardless of refreshes
+	LogoutPath      string        // e.g. /oidc/logout
+	PostLogoutUrl   string        // url the issuer redirects to after logout, if it supports RP-initiated logout
+	Client          *http.Client  // for requests to the issuer, default with a 10s timeout
+}
+
+// Middleware authenticates requests with an encrypted session cookie, set after the authorization code flow with the
+// issuer. Expired ID tokens are refreshed with the refresh token, if the issuer gave one.
+func Middleware(ctx context.Context, o Options) epoxy.Middleware {
+	if o.Issuer == "" || o.ClientId == "" || o.RedirectUrl == "" {
+		log.New().Fatal("oidc: issuer, client id and redirect url required")
+	}
+	redirectUrl, err := url.Parse(o.RedirectUrl)
+	if err != nil || redirectUrl.Path == "" {
+		log.New().WithError(err).Fatal("oidc: invalid redirect url")
+	}
+	if o.SessionDuration <= 0 {
+		log.New().Fatal("oidc: session duration negative or zero")
+	}
+	sealer, err := newSealer(o.SessionKey)
+	if err != nil {
+		log.New().WithError(err).Fatal("oidc: invalid session key")
+	}
+	if len(o.Scopes) == 0 {
+		o.Scopes = []string{"openid", "email", "profile"}
+	}
+	if o.Client == nil {
+		o.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	rp := &relyingParty{
+		Options:      o,
+		callbackPath: redirectUrl.Path,
+		sealer:       sealer,
+		issuer:       &issuer{ctx: ctx, url: o.Issuer, client: o.Client},
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == rp.callbackPath:
+				rp.callback(w, r)
+				return
+			case rp.LogoutPath != "" && r.URL.Path == rp.LogoutPath:
+				rp.logout(w, r)
+				return
+			}
+
+			claims, err := rp.session(w, r)
+			if err != nil {
+				log.New().WithField("oidc", err.Error()).AddToContext(r.Context())
+				rp.login(w, r)
+				return
+			}
+			email, _ := claims["email"].(string)
+			log.New().WithField("email", email).WithField("oidc", "session active").AddToContext(r.Context())
+			ctx := context.WithValue(r.Context(), contextKey{}, claims)
+			ctx = epoxy.WithIdentity(ctx, &epoxy.Identity{Type: epoxy.IdentityUser, Email: email, Claims: claims})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Claims returns the ID token claims of the session, set by Middleware.
+func Claims(ctx context.Context) (jwt.MapClaims, error) {
+	if c, ok := ctx.Value(contextKey{}).(jwt.MapClaims); ok {
+		return c, nil
+	}
+	return nil, errors.New("couldn't get oidc claims from context, make sure oidc.Middleware has run")
+}
+
+type relyingParty struct {
+	Options
+	callbackPath string
+	sealer       *sealer
+	issuer       *issuer
+}
+
+// session returns the ID token claims of the session of the request, refreshing the tokens if expired.
+func (rp *relyingParty) session(w http.ResponseWriter, r *http.Request) (jwt.MapClaims, error) {
+	value, ok := readChunked(r, cookieName)
+	if !ok {
+		return nil, errors.New("no session")
+	}
+	var s session
+	err := rp.sealer.open(cookieName, value, &s)
+	if err != nil {
+		return nil, errors.New("invalid session")
+	}
+	if time.Now().After(s.SessionEnd) {
+		return nil, errors.New("session ended")
+	}
+	if time.Now().After(s.Expiry) {
+		if s.RefreshToken == "" {
+			return nil, errors.New("session expired")
+		}
+		err = rp.refresh(r.Context(), &s)
+		if err != nil {
+			log.New().WithError(err).AddToContext(r.Context())
+			return nil, errors.New("refresh failed")
+		}
+		err = rp.setSession(w, r, &s)
+		if err != nil {
+			return nil, err
+		}
+		log.New().WithField("oidc_refreshed", true).AddToContext(r.Context())
+	}
+	claims := jwt.MapClaims{}
+	_, _, err = jwt.NewParser().ParseUnverified(s.IdToken, claims)
+	if err != nil {
+		return nil, errors.New("invalid session id token")
+	}
+	return claims, nil
+}
+
+func (rp *relyingParty) refresh(ctx context.Context, s *session) error {
+	d, keys, err := rp.issuer.discover(ctx)
+	if err != nil {
+		return err
+	}
+	t, err := rp.issuer.token(ctx, d, rp.ClientId, rp.ClientSecret, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.RefreshToken},
+		"scope":         {strings.Join(rp.Scopes, " ")},
+	})
+	if err != nil {
+		return err
+	}
+	// the issuer may not return a new ID token on refresh, the claims of the previous one are kept then
+	expiry := expiresIn(t.ExpiresIn, time.Hour)
+	if t.IdToken != "" {
+		idToken, err := rp.verify(d, keys, t.IdToken)
+		if err != nil {
+			return err
+		}
+		s.IdToken = t.IdToken
+		if exp, err := idToken.Claims.GetExpirationTime(); err == nil && exp != nil {
+			expiry = exp.Time
+		}
+	}
+	if t.RefreshToken != "" {
+		s.RefreshToken = t.RefreshToken
+	}
+	s.Expiry = expiry
+	return nil
+}
+
+// login redirects browsers to the issuer, other clients get 401.
+func (rp *relyingParty) login(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		errorpage.Write(w, r, http.StatusUnauthorized)
+		return
+	}
+	d, _, err := rp.issuer.discover(r.Context())
+	if err != nil {
+		log.New().WithError(err).AddToContext(r.Context())
+		errorpage.Write(w, r, http.StatusBadGateway)
+		return
+	}
+	state := loginState{
+		State:        randomString(24),
+		Nonce:        randomString(24),
+		CodeVerifier: randomString(32),
+		ReturnTo:     r.URL.RequestURI(),
+	}
+	value, err := rp.sealer.seal(stateCookieName, state)
+	if err != nil {
+		log.New().WithError(err).AddToContext(r.Context())
+		errorpage.Write(w, r, http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, rp.stateCookie(r, state.State, value, time.Now().Add(stateDuration)))
+
+	challenge := sha256.Sum256([]byte(state.CodeVerifier))
+	authUrl, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		log.New().WithError(err).AddToContext(r.Context())
+		errorpage.Write(w, r, http.StatusBadGateway)
+		return
+	}
+	q := authUrl.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", rp.ClientId)
+	q.Set("redirect_uri", rp.RedirectUrl)
+	q.Set("scope", strings.Join(rp.Scopes, " "))
+	q.Set("state", state.State)
+	q.Set("nonce", state.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	authUrl.RawQuery = q.Encode()
+	log.New().WithField("oidc", "redirect to issuer").AddToContext(r.Context())
+	http.Redirect(w, r, authUrl.String(), http.StatusFound)
+}
+
+func (rp *relyingParty) callback(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, err error) {
+		log.New().WithError(fmt.Errorf("oidc: callback: %w", err)).AddToContext(r.Context())
+		errorpage.Write(w, r, status)
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		fail(http.StatusUnauthorized, fmt.Errorf("issuer error %s %s", e, r.URL.Query().Get("error_description")))
+		return
+	}
+	stateParam := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(stateName(stateParam))
+	if stateParam == "" || err != nil {
+		fail(http.StatusBadRequest, errors.New("no login state"))
+		return
+	}
+	var state loginState
+	err = rp.sealer.open(stateCookieName, cookie.Value, &state)
+	if err != nil || state.State != stateParam {
+		fail(http.StatusBadRequest, errors.New("state not matching"))
+		return
+	}
+	http.SetCookie(w, rp.stateCookie(r, stateParam, "", time.Unix(0, 0)))
+
+	d, keys, err := rp.issuer.discover(r.Context())
+	if err != nil {
+		fail(http.StatusBadGateway, err)
+		return
+	}
+	t, err := rp.issuer.token(r.Context(), d, rp.ClientId, rp.ClientSecret, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {r.URL.Query().Get("code")},
+		"redirect_uri":  {rp.RedirectUrl},
+		"code_verifier": {state.CodeVerifier},
+	})
+	if err != nil {
+		fail(http.StatusUnauthorized, err)
+		return
+	}
+	idToken, err := rp.verify(d, keys, t.IdToken)
+	if err != nil {
+		fail(http.StatusUnauthorized, err)
+		return
+	}
+	claims, _ := idToken.Claims.(jwt.MapClaims)
+	if nonce, _ := claims["nonce"].(string); nonce != state.Nonce {
+		fail(http.StatusUnauthorized, errors.New("nonce not matching"))
+		return
+	}
+	s := &session{
+		IdToken:      t.IdToken,
+		RefreshToken: t.RefreshToken,
+		Expiry:       expiresIn(t.ExpiresIn, time.Hour),
+		SessionEnd:   time.Now().Add(rp.SessionDuration),
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		s.Expiry = exp.Time
+	}
+	err = rp.setSession(w, r, s)
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	email, _ := claims["email"].(string)
+	log.New().WithField("email", email).WithField("oidc", "success, set cookie").AddToContext(r.Context())
+	http.Redirect(w, r, safeReturnTo(state.ReturnTo), http.StatusFound)
+}
+
+// logout ends the session, and the session at the issuer if it supports RP-initiated logout.
+func (rp *relyingParty) logout(w http.ResponseWriter, r *http.Request) {
+	var s session
+	if value, ok := readChunked(r, cookieName); ok {
+		_ = rp.sealer.open(cookieName, value, &s)
+	}
+	for _, name := range chunkNames(r, cookieName) {
+		http.SetCookie(w, rp.cookie(r, name, "", time.Unix(0, 0)))
+	}
+	log.New().WithField("oidc", "logout").AddToContext(r.Context())
+
+	d, _, err := rp.issuer.discover(r.Context())
+	if err != nil || d.EndSessionEndpoint == "" {
+		target := rp.PostLogoutUrl
+		if target == "" {
+			target = "/"
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	endSession, err := url.Parse(d.EndSessionEndpoint)
+	if err != nil {
+		log.New().WithError(err).AddToContext(r.Context())
+		errorpage.Write(w, r, http.StatusBadGateway)
+		return
+	}
+	q := endSession.Query()
+	q.Set("client_id", rp.ClientId)
+	if s.IdToken != "" {
+		q.Set("id_token_hint", s.IdToken)
+	}
+	if rp.PostLogoutUrl != "" {
+		q.Set("post_logout_redirect_uri", rp.PostLogoutUrl)
+	}
+	endSession.RawQuery = q.Encode()
+	http.Redirect(w, r, endSession.String(), http.StatusFound)
+}
+
+func (rp *relyingParty) verify(d *discovery, keys *jwk.Provider, idToken string) (*jwt.Token, error) {
+	if idToken == "" {
+		return nil, errors.New("oidc: no id token")
+	}
+	t, err := keys.Parse(idToken, nil,
+		jwk.WithIssuer(d.Issuer),
+		jwk.WithAudience(rp.ClientId),
+		jwk.WithRequiredClaims("exp", "sub"),
+		jwk.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid id token: %w", err)
+	}
+	return t, nil
+}
+
+// setSession sets the session cookie, split into chunks if too large for one cookie, and expires chunks left from a
+// larger session.
+func (rp *relyingParty) setSession(w http.ResponseWriter, r *http.Request, s *session) error {
+	value, err := rp.sealer.seal(cookieName, s)
+	if err != nil {
+		return err
+	}
+	chunks, err := chunk(value)
+	if err != nil {
+		return err
+	}
+	for i, c := range chunks {
+		http.SetCookie(w, rp.cookie(r, chunkName(cookieName, i), c, s.SessionEnd))
+	}
+	for i := len(chunks); i < maxChunks; i++ {
+		if _, err := r.Cookie(chunkName(cookieName, i)); err == nil {
+			http.SetCookie(w, rp.cookie(r, chunkName(cookieName, i), "", time.Unix(0, 0)))
+		}
+	}
+	return nil
+}
+
+func (rp *relyingParty) cookie(r *http.Request, name string, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   r.TLS != nil || !localhost.Is(r.Host),
+		HttpOnly: true,
+		// Lax, since the state cookie must be sent on the redirect back from the issuer
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// stateName is the name of the state cookie of the login with state, one per login so logins in several tabs don't
+// overwrite each other's state.
+func stateName(state string) string {
+	return stateCookieName + "-" + state
+}
+
+// stateCookie is the state cookie of the login with state, only sent to the callback.
+func (rp *relyingParty) stateCookie(r *http.Request, state string, value string, expires time.Time) *http.Cookie {
+	c := rp.cookie(r, stateName(state), value, expires)
+	if rp.callbackPath != "" {
+		c.Path = rp.callbackPath
+	}
+	return c
+}
+
+// safeReturnTo only allows returning to a local path, not to another host.
+func safeReturnTo(returnTo string) string {
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		return "/"
+	}
+	return returnTo
+}
@@ -0,0 +1,456 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/modfin/epoxy/internal/keyset"
+	"github.com/modfin/epoxy/internal/log"
+	"github.com/modfin/epoxy/pkg/jwk"
+)
+
+const (
+	testClientId    = "epoxy"
+	testRedirectUrl = "https://app.example.com/oidc/callback"
+	testEmail       = "user@example.com"
+)
+
+// stubIssuer serves the discovery, JWKS and token endpoints of an issuer, accepting the code "code" of the last
+// authorization request.
+type stubIssuer struct {
+	*httptest.Server
+	keys *keyset.KeySet
+
+	mu           sync.Mutex
+	challenge    string         // code_challenge of the last authorization request
+	nonce        string         // of the last authorization request
+	idTokenTtl   time.Duration  // of the issued ID tokens
+	extra        map[string]any // claims added to the issued ID tokens
+	refreshToken string         // last issued
+	grants       []string       // grant types of the token requests
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := keyset.New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubIssuer{keys: keys, idTokenTtl: time.Hour}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(discovery{
+			Issuer:                s.URL,
+			AuthorizationEndpoint: s.URL + "/authorize",
+			TokenEndpoint:         s.URL + "/token",
+			JwksUri:               s.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		var set jwk.KeySet
+		for _, k := range s.keys.PublicKeys() {
+			key, _ := jwk.FromECPublicKey(k)
+			set.Keys = append(set.Keys, key)
+		}
+		_ = json.NewEncoder(w).Encode(set)
+	})
+	mux.HandleFunc("POST /token", s.token)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stubIssuer) token(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.grants = append(s.grants, r.FormValue("grant_type"))
+	invalid := func(desc string) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(tokenResponse{Error: "invalid_grant", ErrorDesc: desc})
+	}
+	var nonce string
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "code" {
+			invalid("unknown code")
+			return
+		}
+		if base64.RawURLEncoding.EncodeToString(verifier[:]) != s.challenge {
+			invalid("code verifier not matching")
+			return
+		}
+		nonce = s.nonce
+	case "refresh_token":
+		if s.refreshToken == "" || r.FormValue("refresh_token") != s.refreshToken {
+			invalid("unknown refresh token")
+			return
+		}
+	default:
+		invalid("unsupported grant type")
+		return
+	}
+	claims := jwt.MapClaims{
+		"iss":   s.URL,
+		"aud":   testClientId,
+		"sub":   "user",
+		"email": testEmail,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(s.idTokenTtl).Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	for k, v := range s.extra {
+		claims[k] = v
+	}
+	idToken, err := s.keys.Sign(claims)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.refreshToken = randomString(16)
+	_ = json.NewEncoder(w).Encode(tokenResponse{IdToken: idToken, RefreshToken: s.refreshToken, ExpiresIn: int(s.idTokenTtl.Seconds())})
+}
+
+// authorized records the code challenge and nonce of an authorization request, as if the user logged in.
+func (s *stubIssuer) authorized(challenge string, nonce string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.challenge = challenge
+	s.nonce = nonce
+}
+
+func (s *stubIssuer) set(f func(s *stubIssuer)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+}
+
+func (s *stubIssuer) grantTypes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.grants...)
+}
+
+// newRelyingParty returns the middleware under test, answering authenticated requests with the session email.
+func newRelyingParty(t *testing.T, issuer *stubIssuer) http.Handler {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	m := Middleware(t.Context(), Options{
+		Issuer:          issuer.URL,
+		ClientId:        testClientId,
+		RedirectUrl:     testRedirectUrl,
+		SessionKey:      key,
+		SessionDuration: time.Hour,
+		Client:          issuer.Client(),
+	})
+	return log.Middleware(m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := Claims(r.Context())
+		if err != nil {
+			t.Error(err)
+		}
+		_, _ = w.Write([]byte(claims["email"].(string)))
+	})))
+}
+
+func serve(h http.Handler, target string, accept string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// redirectToIssuer requests target as a browser without a session, and returns the query of the authorization request
+// and the state cookie.
+func redirectToIssuer(t *testing.T, h http.Handler, target string) (url.Values, []*http.Cookie) {
+	t.Helper()
+	rec := serve(h, target, "text/html", nil)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("expected redirect to issuer, got %d", rec.Code)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := location.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("expected a S256 code challenge, got %q", location.RawQuery)
+	}
+	return q, rec.Result().Cookies()
+}
+
+// login runs the authorization code flow for target, and returns the session cookies.
+func login(t *testing.T, issuer *stubIssuer, h http.Handler, target string) []*http.Cookie {
+	t.Helper()
+	q, stateCookies := redirectToIssuer(t, h, target)
+	issuer.authorized(q.Get("code_challenge"), q.Get("nonce"))
+	rec := serve(h, "/oidc/callback?code=code&state="+url.QueryEscape(q.Get("state")), "text/html", stateCookies)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != target {
+		t.Fatalf("expected redirect to %s, got %d %s", target, rec.Code, rec.Header().Get("Location"))
+	}
+	return sessionCookies(rec)
+}
+
+func sessionCookies(rec *httptest.ResponseRecorder) []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if strings.HasPrefix(c.Name, cookieName) && !strings.HasPrefix(c.Name, stateCookieName) && c.Value != "" {
+			cookies = append(cookies, c)
+		}
+	}
+	return cookies
+}
+
+func TestCodeExchange(t *testing.T) {
+	issuer := newStubIssuer(t)
+	h := newRelyingParty(t, issuer)
+
+	cookies := login(t, issuer, h, "/app?x=1")
+	rec := serve(h, "/app", "", cookies)
+	if rec.Code != http.StatusOK || rec.Body.String() != testEmail {
+		t.Fatalf("expected session of %s, got %d %q", testEmail, rec.Code, rec.Body.String())
+	}
+	if grants := issuer.grantTypes(); len(grants) != 1 || grants[0] != "authorization_code" {
+		t.Fatalf("expected one code exchange, got %v", grants)
+	}
+}
+
+func TestNoSession(t *testing.T) {
+	issuer := newStubIssuer(t)
+	h := newRelyingParty(t, issuer)
+
+	rec := serve(h, "/app", "application/json", nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for non-browser clients, got %d", rec.Code)
+	}
+}
+
+func TestStateMismatch(t *testing.T) {
+	issuer := newStubIssuer(t)
+	h := newRelyingParty(t, issuer)
+
+	q, stateCookies := redirectToIssuer(t, h, "/app")
+	issuer.authorized(q.Get("code_challenge"), q.Get("nonce"))
+	for _, tc := range []struct {
+		name    string
+		state   string
+		cookies []*http.Cookie
+	}{
+		{name: "other state", state: "other", cookies: stateCookies},
+		{name: "no state cookie", state: q.Get("state")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := serve(h, "/oidc/callback?code=code&state="+url.QueryEscape(tc.state), "text/html", tc.cookies)
+			if rec.Code != http.StatusBadRequest || len(sessionCookies(rec)) > 0 {
+				t.Fatalf("expected 400 without session, got %d", rec.Code)
+			}
+		})
+	}
+	if grants := issuer.grantTypes(); len(grants) > 0 {
+		t.Fatalf("expected no code exchange, got %v", grants)
+	}
+}
+
+func TestPkceMismatch(t *testing.T) {
+	issuer := newStubIssuer(t)
+	h := newRelyingParty(t, issuer)
+
+	q, stateCookies := redirectToIssuer(t, h, "/app")
+	// as if the code was issued for the challenge of another login
+	issuer.authorized(base64.RawURLEncoding.EncodeToString([]byte("another challenge")), q.Get("nonce"))
+	rec := serve(h, "/oidc/callback?code=code&state="+url.QueryEscape(q.Get("state")), "text/html", stateCookies)
+	if rec.Code != http.StatusUnauthorized || len(sessionCookies(rec)) > 0 {
+		t.Fatalf("expected 401 without session, got %d", rec.Code)
+	}
+}
+
+func TestNonceMismatch(t *testing.T) {
+	issuer := newStubIssuer(t)
+	h := newRelyingParty(t, issuer)
+
+	q, stateCookies := redirectToIssuer(t, h, "/app")
+	issuer.authorized(q.Get("code_challenge"), "other")
+	rec := serve(h, "/oidc/callback?code=code&state="+url.QueryEscape(q.Get("state")), "text/html", stateCookies)
+	if rec.Code != http.StatusUnauthorized || len(sessionCookies(rec)) > 0 {
+		t.Fatalf("expected 401 without session, got %d", rec.Code)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	issuer := newStubIssuer(t)
+	h := newRelyingParty(t, issuer)
+
+	// expired, but within the leeway of the verification, so the session needs a refresh on the next request
+	issuer.set(func(s *stubIssuer) { s.idTokenTtl = -30 * time.Second })
+	cookies := login(t, issuer, h, "/app")
+	issuer.set(func(s *stubIssuer) { s.idTokenTtl = time.Hour })
+
+	rec := serve(h, "/app", "", cookies)
+	if rec.Code != http.StatusOK || rec.Body.String() != testEmail {
+		t.Fatalf("expected refreshed session of %s, got %d %q", testEmail, rec.Code, rec.Body.String())
+	}
+	refreshed := sessionCookies(rec)
+	if len(refreshed) == 0 {
+		t.Fatal("expected refreshed session cookie")
+	}
+	rec = serve(h, "/app", "", refreshed)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected refreshed session, got %d", rec.Code)
+	}
+	if grants := issuer.grantTypes(); strings.Join(grants, ",") != "authorization_code,refresh_token" {
+		t.Fatalf("expected a code exchange and one refresh, got %v", grants)
+	}
+
+	// the first session's refresh token was replaced by the refresh
+	rec = serve(h, "/app", "", cookies)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 after failed refresh, got %d", rec.Code)
+	}
+}
+
+func TestChunkedSession(t *testing.T) {
+	issuer := newStubIssuer(t)
+	h := newRelyingParty(t, issuer)
+
+	issuer.set(func(s *stubIssuer) { s.extra = map[string]any{"groups": strings.Repeat("g", 2*chunkSize)} })
+	cookies := login(t, issuer, h, "/app")
+	if len(cookies) < 2 {
+		t.Fatalf("expected session split into chunks, got %d cookies", len(cookies))
+	}
+	for _, c := range cookies {
+		if len(c.String()) > 4096 {
+			t.Fatalf("cookie %s of %d bytes too large", c.Name, len(c.String()))
+		}
+	}
+	rec := serve(h, "/app", "", cookies)
+	if rec.Code != http.StatusOK || rec.Body.String() != testEmail {
+		t.Fatalf("expected session of %s, got %d %q", testEmail, rec.Code, rec.Body.String())
+	}
+}
+
+func TestSessionTooLarge(t *testing.T) {
+	issuer := newStubIssuer(t)
+	h := newRelyingParty(t, issuer)
+
+	issuer.set(func(s *stubIssuer) { s.extra = map[string]any{"groups": strings.Repeat("g", maxChunks*chunkSize)} })
+	q, stateCookies := redirectToIssuer(t, h, "/app")
+	issuer.authorized(q.Get("code_challenge"), q.Get("nonce"))
+	rec := serve(h, "/oidc/callback?code=code&state="+url.QueryEscape(q.Get("state")), "text/html", stateCookies)
+	if rec.Code != http.StatusInternalServerError || len(sessionCookies(rec)) > 0 {
+		t.Fatalf("expected 500 without session, got %d", rec.Code)
+	}
+}
+
+func TestConcurrentLogins(t *testing.T) {
+	issuer := newStubIssuer(t)
+	h := newRelyingParty(t, issuer)
+
+	// two tabs redirected to the issuer, the browser keeps the state cookies of both
+	q1, cookies1 := redirectToIssuer(t, h, "/one")
+	q2, cookies2 := redirectToIssuer(t, h, "/two")
+	cookies := append(cookies1, cookies2...)
+	for _, c := range cookies {
+		if c.Path != "/oidc/callback" {
+			t.Errorf("expected state cookie %s only sent to the callback, got path %s", c.Name, c.Path)
+		}
+	}
+
+	for _, tc := range []struct {
+		q      url.Values
+		target string
+	}{
+		{q: q1, target: "/one"},
+		{q: q2, target: "/two"},
+	} {
+		issuer.authorized(tc.q.Get("code_challenge"), tc.q.Get("nonce"))
+		rec := serve(h, "/oidc/callback?code=code&state="+url.QueryEscape(tc.q.Get("state")), "text/html", cookies)
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != tc.target {
+			t.Fatalf("expected redirect to %s, got %d %s", tc.target, rec.Code, rec.Header().Get("Location"))
+		}
+		var expired []string
+		for _, c := range rec.Result().Cookies() {
+			if strings.HasPrefix(c.Name, stateCookieName) && c.Expires.Before(time.Now()) {
+				expired = append(expired, c.Name)
+			}
+		}
+		if len(expired) != 1 || expired[0] != stateName(tc.q.Get("state")) {
+			t.Errorf("expected only the state cookie of the login to expire, got %v", expired)
+		}
+	}
+}
+
+func TestDiscoveryNotBlockedBySlowRequest(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			<-release
+		}
+		_ = json.NewEncoder(w).Encode(discovery{
+			Issuer:                server.URL,
+			AuthorizationEndpoint: server.URL + "/authorize",
+			TokenEndpoint:         server.URL + "/token",
+			JwksUri:               server.URL + "/jwks",
+		})
+	}))
+	defer server.Close()
+	defer close(release)
+	i := &issuer{ctx: t.Context(), url: server.URL, client: server.Client()}
+
+	slow := make(chan *jwk.Provider, 1)
+	go func() {
+		_, keys, _ := i.discover(t.Context())
+		slow <- keys
+	}()
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	type result struct {
+		keys *jwk.Provider
+		err  error
+	}
+	fast := make(chan result, 1)
+	go func() {
+		_, keys, err := i.discover(t.Context())
+		fast <- result{keys, err}
+	}()
+	var keys *jwk.Provider
+	select {
+	case res := <-fast:
+		if res.err != nil {
+			t.Fatalf("expected discovery while another is pending, got %v", res.err)
+		}
+		keys = res.keys
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected discovery not to wait for another pending one")
+	}
+	release <- struct{}{}
+	if slowKeys := <-slow; slowKeys != keys {
+		t.Error("expected a single key provider")
+	}
+}
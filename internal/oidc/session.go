@@ -0,0 +1,134 @@
+package oidc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// chunkSize keeps each cookie, with its name and attributes, below the 4096 bytes browsers are required to store
+	chunkSize = 3800
+	// maxChunks limits the cookies of a session, browsers store at least 50 per domain and send at most about 8KB to
+	// 16KB of headers
+	maxChunks = 4
+)
+
+// session is stored AES-GCM encrypted in the session cookie, so the ID token in it is trusted without verifying it again.
+type session struct {
+	IdToken      string    `json:"id_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry"`      // of the tokens, refreshed after if there is a refresh token
+	SessionEnd   time.Time `json:"session_end"` // of the session, regardless of refreshes
+}
+
+// loginState is stored AES-GCM encrypted in the state cookie, between the redirect to the issuer and the callback.
+type loginState struct {
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	ReturnTo     string `json:"return_to"`
+}
+
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer(key []byte) (*sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// seal encrypts v, bound to name so the value of one cookie can't be used as another.
+func (s *sealer) seal(name string, v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(s.aead.Seal(nonce, nonce, b, []byte(name))), nil
+}
+
+func (s *sealer) open(name string, value string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	if len(b) < s.aead.NonceSize() {
+		return errors.New("oidc: sealed value too short")
+	}
+	plain, err := s.aead.Open(nil, b[:s.aead.NonceSize()], b[s.aead.NonceSize():], []byte(name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, v)
+}
+
+// chunk splits value into the values of the chunk cookies, failing if it is too large even when split.
+func chunk(value string) ([]string, error) {
+	if len(value) > chunkSize*maxChunks {
+		return nil, fmt.Errorf("oidc: session of %d bytes too large for %d cookies", len(value), maxChunks)
+	}
+	var chunks []string
+	for len(value) > chunkSize {
+		chunks = append(chunks, value[:chunkSize])
+		value = value[chunkSize:]
+	}
+	return append(chunks, value), nil
+}
+
+// chunkName is name for the first chunk, so sessions small enough for one cookie keep the name, and name-<i> for the
+// rest.
+func chunkName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s-%d", name, i)
+}
+
+// chunkNames returns the names of the chunk cookies of name sent with r.
+func chunkNames(r *http.Request, name string) []string {
+	var names []string
+	for i := 0; i < maxChunks; i++ {
+		if _, err := r.Cookie(chunkName(name, i)); err == nil {
+			names = append(names, chunkName(name, i))
+		}
+	}
+	return names
+}
+
+// readChunked joins the chunk cookies of name sent with r, false if the first one is missing.
+func readChunked(r *http.Request, name string) (string, bool) {
+	var value string
+	for i := 0; i < maxChunks; i++ {
+		c, err := r.Cookie(chunkName(name, i))
+		if err != nil {
+			break
+		}
+		value += c.Value
+	}
+	return value, value != ""
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,29 @@
+package sanitize
+
+import (
+	"net/http"
+
+	"github.com/modfin/epoxy/internal/log"
+	"github.com/modfin/epoxy/pkg/epoxy"
+)
+
+// Middleware removes headers from inbound requests, so identity headers set by epoxy's own middlewares can't be
+// supplied by clients.
+func Middleware(headers []string) epoxy.Middleware {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			var stripped []string
+			for _, h := range headers {
+				if _, ok := r.Header[http.CanonicalHeaderKey(h)]; ok {
+					r.Header.Del(h)
+					stripped = append(stripped, h)
+				}
+			}
+			if len(stripped) > 0 {
+				log.New().WithField("stripped_headers", stripped).AddToContext(r.Context())
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,37 @@
+package status
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/modfin/epoxy/pkg/epoxy"
+)
+
+// Middleware serves the health of all upstreams of e as JSON at path.
+func Middleware(path string, e epoxy.Epoxy) epoxy.Middleware {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != path {
+				next.ServeHTTP(w, r)
+				return
+			}
+			upstreams := e.Status()
+			healthy := true
+			for _, u := range upstreams {
+				healthy = healthy && u.Healthy
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if !healthy {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			_ = json.NewEncoder(w).Encode(struct {
+				Healthy   bool                   `json:"healthy"`
+				Upstreams []epoxy.UpstreamStatus `json:"upstreams"`
+			}{
+				Healthy:   healthy,
+				Upstreams: upstreams,
+			})
+		}
+		return http.HandlerFunc(fn)
+	}
+}
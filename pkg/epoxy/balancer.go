@@ -0,0 +1,194 @@
+package epoxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConn  = "least_conn"
+	BalanceRandom     = "random"
+	BalanceHash       = "hash"
+)
+
+type upstream struct {
+	target   *url.URL
+	director func(*http.Request)
+	active   atomic.Int64
+	healthy  atomic.Bool
+	health   health
+}
+
+func newUpstream(target string) (*upstream, error) {
+	t, err := url.Parse(strings.TrimSpace(target))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse route target: %w", err)
+	}
+	if t.Scheme == "" || t.Host == "" {
+		return nil, fmt.Errorf("route target '%s' requires a scheme and host", target)
+	}
+	u := &upstream{
+		target:   t,
+		director: httputil.NewSingleHostReverseProxy(t).Director,
+	}
+	u.healthy.Store(true)
+	return u, nil
+}
+
+type balancer interface {
+	pick(r *http.Request, candidates []*upstream) *upstream
+}
+
+type pool struct {
+	route     Route
+	upstreams []*upstream
+	balancer  balancer
+}
+
+func newPool(r Route) (*pool, error) {
+	targets := r.targets()
+	if len(targets) == 0 {
+		return nil, errors.New("route target required")
+	}
+	b, err := newBalancer(r.Balance, r.HashKey)
+	if err != nil {
+		return nil, err
+	}
+	p := &pool{route: r, balancer: b}
+	for _, t := range targets {
+		u, err := newUpstream(t)
+		if err != nil {
+			return nil, err
+		}
+		p.upstreams = append(p.upstreams, u)
+	}
+	p.configureHealth(r)
+	return p, nil
+}
+
+// next picks a healthy upstream not in exclude, nil is returned if there is none.
+func (p *pool) next(r *http.Request, exclude ...*upstream) *upstream {
+	candidates := make([]*upstream, 0, len(p.upstreams))
+outer:
+	for _, u := range p.upstreams {
+		if !u.available() {
+			continue
+		}
+		for _, e := range exclude {
+			if u == e {
+				continue outer
+			}
+		}
+		candidates = append(candidates, u)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	return p.balancer.pick(r, candidates)
+}
+
+func newBalancer(balance string, hashKey string) (balancer, error) {
+	switch strings.ToLower(strings.TrimSpace(balance)) {
+	case "", BalanceRoundRobin:
+		return &roundRobin{}, nil
+	case BalanceLeastConn:
+		return &leastConn{}, nil
+	case BalanceRandom:
+		return random{}, nil
+	case BalanceHash:
+		source, name, _ := strings.Cut(hashKey, ":")
+		source = strings.ToLower(strings.TrimSpace(source))
+		name = strings.TrimSpace(name)
+		if (source != "header" && source != "cookie") || name == "" {
+			return nil, fmt.Errorf("hash balancing requires hash_key 'header:<name>' or 'cookie:<name>', got '%s'", hashKey)
+		}
+		return hash{source: source, name: name}, nil
+	}
+	return nil, fmt.Errorf("unknown balance policy '%s'", balance)
+}
+
+type roundRobin struct {
+	counter atomic.Uint64
+}
+
+func (b *roundRobin) pick(_ *http.Request, candidates []*upstream) *upstream {
+	return candidates[(b.counter.Add(1)-1)%uint64(len(candidates))]
+}
+
+type leastConn struct {
+	counter atomic.Uint64
+}
+
+func (b *leastConn) pick(_ *http.Request, candidates []*upstream) *upstream {
+	// start at a rotating offset, so ties are spread over the candidates
+	offset := int(b.counter.Add(1) % uint64(len(candidates)))
+	var best *upstream
+	for i := range candidates {
+		u := candidates[(offset+i)%len(candidates)]
+		if best == nil || u.active.Load() < best.active.Load() {
+			best = u
+		}
+	}
+	return best
+}
+
+type random struct{}
+
+func (random) pick(_ *http.Request, candidates []*upstream) *upstream {
+	return candidates[rand.IntN(len(candidates))]
+}
+
+// hash uses rendezvous hashing, so only keys of a removed upstream move when the set of healthy upstreams changes.
+type hash struct {
+	source string
+	name   string
+}
+
+func (b hash) pick(r *http.Request, candidates []*upstream) *upstream {
+	var key string
+	switch b.source {
+	case "header":
+		key = r.Header.Get(b.name)
+	case "cookie":
+		if c, err := r.Cookie(b.name); err == nil {
+			key = c.Value
+		}
+	}
+	if key == "" {
+		return random{}.pick(r, candidates)
+	}
+	var best *upstream
+	var bestScore uint64
+	for _, u := range candidates {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(u.target.String()))
+		_, _ = h.Write([]byte(key))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = u, score
+		}
+	}
+	return best
+}
+
+type upstreamContextKey struct{}
+
+func withUpstream(ctx context.Context, u *upstream) context.Context {
+	return context.WithValue(ctx, upstreamContextKey{}, u)
+}
+
+func upstreamFromContext(ctx context.Context) *upstream {
+	u, _ := ctx.Value(upstreamContextKey{}).(*upstream)
+	return u
+}
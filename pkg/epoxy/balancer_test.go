@@ -0,0 +1,129 @@
+package epoxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNewUpstream(t *testing.T) {
+	for target, valid := range map[string]bool{
+		"http://127.0.0.1:8080":   true,
+		" http://127.0.0.1:8080 ": true,
+		"https://api.example.com": true,
+		"":                        false,
+		" ":                       false,
+		"127.0.0.1:8080":          false,
+		"api.example.com":         false,
+		"http://":                 false,
+		"/api":                    false,
+	} {
+		u, err := newUpstream(target)
+		if valid && err != nil {
+			t.Errorf("%q: unexpected error: %v", target, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("%q: expected an error, got target %s", target, u.target)
+		}
+	}
+}
+
+func newTestPool(t *testing.T, balance string, n int) *pool {
+	t.Helper()
+	route := Route{Prefix: "/", Balance: balance, HashKey: "header:X-User"}
+	for i := 0; i < n; i++ {
+		route.Targets = append(route.Targets, fmt.Sprintf("http://10.0.0.%d:8080", i))
+	}
+	p, err := newPool(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPoolNext(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		unhealthy []int
+		ejected   []int
+		exclude   []int
+		expected  []int // any of, none if empty
+	}{
+		{name: "all", expected: []int{0, 1, 2}},
+		{name: "exclude one", exclude: []int{0}, expected: []int{1, 2}},
+		{name: "exclude two", exclude: []int{0, 2}, expected: []int{1}},
+		{name: "exclude all", exclude: []int{0, 1, 2}},
+		{name: "unhealthy", unhealthy: []int{1}, expected: []int{0, 2}},
+		{name: "ejected", ejected: []int{2}, expected: []int{0, 1}},
+		{name: "exclude and unhealthy", unhealthy: []int{1}, exclude: []int{0}, expected: []int{2}},
+		{name: "exclude the only healthy", unhealthy: []int{0, 1}, exclude: []int{2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestPool(t, BalanceRoundRobin, 3)
+			for _, i := range tc.unhealthy {
+				p.upstreams[i].healthy.Store(false)
+			}
+			for _, i := range tc.ejected {
+				p.upstreams[i].health.ejectedUntil = time.Now().Add(time.Minute)
+			}
+			var exclude []*upstream
+			for _, i := range tc.exclude {
+				exclude = append(exclude, p.upstreams[i])
+			}
+			picked := map[int]bool{}
+			for i := 0; i < 10; i++ {
+				u := p.next(httptest.NewRequest(http.MethodGet, "/", nil), exclude...)
+				if u == nil {
+					if len(tc.expected) > 0 {
+						t.Fatal("expected an upstream, got none")
+					}
+					return
+				}
+				picked[slices.Index(p.upstreams, u)] = true
+			}
+			if len(tc.expected) == 0 {
+				t.Fatalf("expected no upstream, got %v", picked)
+			}
+			for i := range picked {
+				if !slices.Contains(tc.expected, i) {
+					t.Errorf("expected any of %v, got %d", tc.expected, i)
+				}
+			}
+			if len(picked) != len(tc.expected) {
+				t.Errorf("expected round robin over %v, got %v", tc.expected, picked)
+			}
+		})
+	}
+}
+
+func TestHashStableOnRemoval(t *testing.T) {
+	p := newTestPool(t, BalanceHash, 4)
+	pick := func(key string, candidates []*upstream) *upstream {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User", key)
+		return p.balancer.pick(r, candidates)
+	}
+	removed := p.upstreams[1]
+	remaining := slices.DeleteFunc(slices.Clone(p.upstreams), func(u *upstream) bool { return u == removed })
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		before := pick(key, p.upstreams)
+		if again := pick(key, p.upstreams); again != before {
+			t.Fatalf("%s: expected the same upstream for the same key, got %s and %s", key, before.target, again.target)
+		}
+		after := pick(key, remaining)
+		if before != removed && after != before {
+			t.Errorf("%s: expected to stay on %s, moved to %s", key, before.target, after.target)
+		}
+		if before == removed {
+			moved++
+		}
+	}
+	if moved == 0 || moved == 1000 {
+		t.Errorf("expected keys to be spread over the upstreams, %d of 1000 on the removed one", moved)
+	}
+}
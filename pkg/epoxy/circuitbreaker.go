@@ -0,0 +1,94 @@
+package epoxy
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitBreaker opens after Failures consecutive failed requests (proxy errors or 5xx responses) to a route,
+// answering 503 without contacting the targets until Cooldown has passed. After Cooldown, a single request is let
+// through, closing the circuit on success or opening it again on failure.
+type CircuitBreaker struct {
+	Failures int      `json:"failures,omitempty"` // default 5
+	Cooldown Duration `json:"cooldown,omitempty"` // default 30s
+}
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(c *CircuitBreaker) *circuitBreaker {
+	if c == nil {
+		return nil
+	}
+	threshold := c.Failures
+	if threshold <= 0 {
+		threshold = 5
+	}
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  c.Cooldown.or(30 * time.Second),
+	}
+}
+
+// allow reports if a request may pass, and the state of the circuit it passes or is rejected in.
+func (c *circuitBreaker) allow() (bool, string) {
+	if c == nil {
+		return true, circuitClosed
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.openUntil.IsZero() {
+		return true, circuitClosed
+	}
+	if time.Now().Before(c.openUntil) || c.probing {
+		return false, circuitOpen
+	}
+	c.probing = true
+	return true, circuitHalfOpen
+}
+
+// release ends the request let through by allow without an outcome, e.g. as the client went away, so another request
+// can probe a half open circuit.
+func (c *circuitBreaker) release() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probing = false
+}
+
+// record the outcome of a request, returning true if that opened the circuit.
+func (c *circuitBreaker) record(success bool) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wasProbing := c.probing
+	c.probing = false
+	if success {
+		c.failures = 0
+		c.openUntil = time.Time{}
+		return false
+	}
+	c.failures++
+	if wasProbing || c.failures >= c.threshold {
+		c.failures = 0
+		c.openUntil = time.Now().Add(c.cooldown)
+		return true
+	}
+	return false
+}
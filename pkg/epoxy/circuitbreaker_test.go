@@ -0,0 +1,85 @@
+package epoxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	type step struct {
+		op      string // allow, fail, succeed, release or cooldown
+		allowed bool   // of allow
+		circuit string // of allow
+		opened  bool   // of fail and succeed
+	}
+	for _, tc := range []struct {
+		name  string
+		steps []step
+	}{
+		{name: "closed below threshold", steps: []step{
+			{op: "fail"}, {op: "fail"},
+			{op: "allow", allowed: true, circuit: circuitClosed},
+		}},
+		{name: "opens at threshold", steps: []step{
+			{op: "fail"}, {op: "fail"}, {op: "fail", opened: true},
+			{op: "allow", circuit: circuitOpen},
+		}},
+		{name: "success resets failures", steps: []step{
+			{op: "fail"}, {op: "fail"}, {op: "succeed"}, {op: "fail"}, {op: "fail"},
+			{op: "allow", allowed: true, circuit: circuitClosed},
+		}},
+		{name: "single probe after cooldown", steps: []step{
+			{op: "fail"}, {op: "fail"}, {op: "fail", opened: true}, {op: "cooldown"},
+			{op: "allow", allowed: true, circuit: circuitHalfOpen},
+			{op: "allow", circuit: circuitOpen},
+		}},
+		{name: "probe success closes", steps: []step{
+			{op: "fail"}, {op: "fail"}, {op: "fail", opened: true}, {op: "cooldown"},
+			{op: "allow", allowed: true, circuit: circuitHalfOpen},
+			{op: "succeed"},
+			{op: "allow", allowed: true, circuit: circuitClosed},
+		}},
+		{name: "probe failure opens again", steps: []step{
+			{op: "fail"}, {op: "fail"}, {op: "fail", opened: true}, {op: "cooldown"},
+			{op: "allow", allowed: true, circuit: circuitHalfOpen},
+			{op: "fail", opened: true},
+			{op: "allow", circuit: circuitOpen},
+		}},
+		{name: "release lets another probe", steps: []step{
+			{op: "fail"}, {op: "fail"}, {op: "fail", opened: true}, {op: "cooldown"},
+			{op: "allow", allowed: true, circuit: circuitHalfOpen},
+			{op: "release"},
+			{op: "allow", allowed: true, circuit: circuitHalfOpen},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCircuitBreaker(&CircuitBreaker{Failures: 3, Cooldown: Duration(time.Minute)})
+			for i, s := range tc.steps {
+				switch s.op {
+				case "allow":
+					if allowed, circuit := c.allow(); allowed != s.allowed || circuit != s.circuit {
+						t.Fatalf("step %d: expected allowed %t in %s, got %t in %s", i, s.allowed, s.circuit, allowed, circuit)
+					}
+				case "fail", "succeed":
+					if opened := c.record(s.op == "succeed"); opened != s.opened {
+						t.Fatalf("step %d: expected opened %t, got %t", i, s.opened, opened)
+					}
+				case "release":
+					c.release()
+				case "cooldown":
+					c.openUntil = time.Now().Add(-time.Second)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	c := newCircuitBreaker(nil)
+	for i := 0; i < 10; i++ {
+		c.record(false)
+	}
+	if allowed, circuit := c.allow(); !allowed || circuit != circuitClosed {
+		t.Errorf("expected a disabled circuit breaker to allow, got %t in %s", allowed, circuit)
+	}
+}
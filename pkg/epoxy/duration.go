@@ -0,0 +1,42 @@
+package epoxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Duration is a time.Duration that is expressed in JSON as a string in go duration format, e.g. "10s". Numbers are
+// rejected, as it is ambiguous whether they are seconds or nanoseconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		return fmt.Errorf("invalid duration %v, must be a string with unit e.g. \"%vs\"", value, value)
+	case string:
+		tmp, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(tmp)
+		return nil
+	}
+	return errors.New("invalid duration")
+}
+
+func (d Duration) or(fallback time.Duration) time.Duration {
+	if d <= 0 {
+		return fallback
+	}
+	return time.Duration(d)
+}
@@ -2,14 +2,14 @@ package epoxy
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io/fs"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"path"
 	"strings"
+	"sync"
 
 	"github.com/modfin/epoxy/internal/fallbackfs"
 	"github.com/modfin/epoxy/internal/log"
@@ -19,67 +19,103 @@ type Epoxy interface {
 	serve(ctx context.Context) error
 	WithMiddlewares(middlewares []Middleware) Epoxy
 	Finalize(name string, addr string) Epoxy
+	WithTLS(config *tls.Config) Epoxy
+	Status() []UpstreamStatus
+	Authorize(r *http.Request) error
 }
 
 func New(publicDir fs.FS, publicPrefix string, routes ...Route) (Epoxy, error) {
-	mux := http.NewServeMux()
+	var sites []Site
+	if publicDir != nil {
+		sites = append(sites, Site{Dir: publicDir, Prefix: publicPrefix})
+	}
+	return NewWithSites(sites, routes...)
+}
+
+// NewWithSites creates an Epoxy serving static sites and reverse proxy routes, dispatched by host and then by path.
+// Sites and routes without a host are served for any host not matched by a more specific one.
+func NewWithSites(sites []Site, routes ...Route) (Epoxy, error) {
+	router := newHostRouter()
 
-	proxiedRoot := false
+	proxiedRoot := make(map[string]bool)
+	var routeHandlers []*routeHandler
 
 	for _, r := range routes {
-		target, err := url.Parse(r.Target)
+		rh, err := newRouteHandler(r)
 		if err != nil {
-			return nil, fmt.Errorf("could parse target route target: %w", err)
+			return nil, err
 		}
-		p := httputil.NewSingleHostReverseProxy(target)
-
-		// attempt to fix issue with Host header NOT being set to target host on reverse proxy
-		if r.RewriteHost {
-			p = &httputil.ReverseProxy{
-				Rewrite: func(pr *httputil.ProxyRequest) {
-					pr.SetURL(target)
-				},
-			}
-		}
-
+		routeHandlers = append(routeHandlers, rh)
 		prefix := strings.TrimSuffix(r.Prefix, "/")
-		h := http.Handler(p)
+		h := http.Handler(rh)
 		if r.Strip {
-			h = http.StripPrefix(prefix, h)
+			h = strippedRoute{Handler: http.StripPrefix(prefix, rh), route: rh}
 		}
 		if prefix == "" || prefix == "/" {
-			proxiedRoot = true
+			proxiedRoot[normalizeHost(r.Host)] = true
 		}
-		attachToMux(mux, prefix, h)
+		attachToMux(router.mux(r.Host), prefix, h)
 		log.New().
+			WithField("host", r.Host).
 			WithField("prefix", r.Prefix).
-			WithField("target", r.Target).
+			WithField("target", strings.Join(r.targets(), ",")).
+			WithField("balance", r.Balance).
 			WithField("strip", r.Strip).
 			Info("hosting reverse proxy")
 	}
 
-	if publicDir != nil {
-		publicPrefix = path.Clean("/" + strings.TrimPrefix(publicPrefix, "/"))
-		f := fallbackfs.New(publicDir, "index.html")
-		h := http.StripPrefix(publicPrefix, http.FileServer(http.FS(f)))
+	for _, s := range sites {
+		if s.Dir == nil {
+			continue
+		}
+		mux := router.mux(s.Host)
+		publicPrefix := path.Clean("/" + strings.TrimPrefix(s.Prefix, "/"))
+		f := fallbackfs.New(s.Dir, "index.html")
+		h := siteHandler{http.StripPrefix(publicPrefix, http.FileServer(http.FS(f)))}
 		attachToMux(mux, publicPrefix, h)
-		if !proxiedRoot && publicPrefix != "/" {
-			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if !proxiedRoot[normalizeHost(s.Host)] && publicPrefix != "/" {
+			// only the exact root of a host site redirects, so other paths fall through to the default mux
+			rootPattern := "/{$}"
+			if normalizeHost(s.Host) == "" {
+				rootPattern = "/"
+			}
+			mux.Handle(rootPattern, siteHandler{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				http.Redirect(w, r, publicPrefix, http.StatusMovedPermanently)
 				return
-			})
+			})})
 		}
-		log.New().WithField("prefix", publicPrefix).Info("hosting assets directory")
+		log.New().WithField("host", s.Host).WithField("prefix", publicPrefix).Info("hosting assets directory")
 	}
 	return &epoxy{
-		Handler: mux,
+		Handler: router,
+		routes:  &routeSet{handlers: routeHandlers, router: router},
 	}, nil
 }
 
 type epoxy struct {
 	http.Handler
-	name string
-	addr string
+	name   string
+	addr   string
+	tls    *tls.Config
+	routes *routeSet
+}
+
+// routeSet is shared by all copies of an epoxy, so health checks are only started once.
+type routeSet struct {
+	handlers    []*routeHandler
+	router      *hostRouter
+	healthCheck sync.Once
+}
+
+// strippedRoute serves a route with its prefix stripped from the request path.
+type strippedRoute struct {
+	http.Handler
+	route *routeHandler
+}
+
+// siteHandler serves a static site, or redirects to it.
+type siteHandler struct {
+	http.Handler
 }
 
 func (e epoxy) WithMiddlewares(middlewares []Middleware) Epoxy {
@@ -91,6 +127,8 @@ func (e epoxy) WithMiddlewares(middlewares []Middleware) Epoxy {
 		Handler: handler,
 		addr:    e.addr,
 		name:    e.name,
+		tls:     e.tls,
+		routes:  e.routes,
 	}
 }
 
@@ -99,19 +137,111 @@ func (e epoxy) Finalize(name string, addr string) Epoxy {
 		Handler: e.Handler,
 		addr:    addr,
 		name:    name,
+		tls:     e.tls,
+		routes:  e.routes,
+	}
+}
+
+// WithTLS makes the epoxy serve TLS, config must provide certificates e.g. through GetCertificate.
+func (e epoxy) WithTLS(config *tls.Config) Epoxy {
+	return &epoxy{
+		Handler: e.Handler,
+		addr:    e.addr,
+		name:    e.name,
+		tls:     config,
+		routes:  e.routes,
 	}
 }
 
+// Status returns the health of all route targets.
+func (e epoxy) Status() []UpstreamStatus {
+	var status []UpstreamStatus
+	for _, h := range e.routes.handlers {
+		for _, u := range h.pool.upstreams {
+			status = append(status, u.status(h.route))
+		}
+	}
+	return status
+}
+
+// Authorize returns the reason for denying r access to the route it matches, or nil if access is allowed or r matches
+// a static site or nothing at all. It is used to check requests that are proxied by something else, e.g. for forward
+// authentication, so requests the mux would answer itself, e.g. by redirecting an unclean path, are denied since the
+// proxy asking may route them differently.
+func (e epoxy) Authorize(r *http.Request) error {
+	h, pattern := e.routes.router.handler(r)
+	switch h := h.(type) {
+	case *routeHandler:
+		return h.route.authorize(r)
+	case strippedRoute:
+		return h.route.route.authorize(r)
+	case siteHandler:
+		return nil
+	}
+	if pattern == "" {
+		// not found, there are no access rules to apply
+		return nil
+	}
+	return fmt.Errorf("request for '%s' not matching a route or site", r.URL.Path)
+}
+
+type routeMatcher interface {
+	matchRoute(r *http.Request) (Route, bool)
+}
+
+// MatchRoute returns the route of e that r matches, false if r doesn't match a route e.g. for a static site.
+func MatchRoute(e Epoxy, r *http.Request) (Route, bool) {
+	m, ok := e.(routeMatcher)
+	if !ok {
+		return Route{}, false
+	}
+	return m.matchRoute(r)
+}
+
+func (e epoxy) matchRoute(r *http.Request) (Route, bool) {
+	rh := e.routeHandler(r)
+	if rh == nil {
+		return Route{}, false
+	}
+	return rh.route, true
+}
+
+func (e epoxy) routeHandler(r *http.Request) *routeHandler {
+	h, _ := e.routes.router.handler(r)
+	switch h := h.(type) {
+	case *routeHandler:
+		return h
+	case strippedRoute:
+		return h.route
+	}
+	return nil
+}
+
+func (e epoxy) startHealthChecks(ctx context.Context) {
+	e.routes.healthCheck.Do(func() {
+		for _, h := range e.routes.handlers {
+			if h.route.HealthCheck == nil {
+				continue
+			}
+			go h.pool.checkHealth(ctx, *h.route.HealthCheck, h.client)
+		}
+	})
+}
+
 func (e epoxy) serve(ctx context.Context) error {
 	if e.addr == "" {
 		return errors.New("must call Finalize on epoxy before serving")
 	}
-	log.New().WithField("addr", e.addr).Info(fmt.Sprintf("[%s] listening", e.name))
-	server := &http.Server{Addr: e.addr, Handler: e}
+	e.startHealthChecks(ctx)
+	log.New().WithField("addr", e.addr).WithField("tls", e.tls != nil).Info(fmt.Sprintf("[%s] listening", e.name))
+	server := &http.Server{Addr: e.addr, Handler: e, TLSConfig: e.tls}
 	return waitAll(func() error {
 		<-ctx.Done()
 		return server.Shutdown(context.Background())
 	}, func() error {
+		if e.tls != nil {
+			return server.ListenAndServeTLS("", "")
+		}
 		return server.ListenAndServe()
 	})
 }
@@ -0,0 +1,223 @@
+package epoxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/modfin/epoxy/internal/log"
+)
+
+// HealthCheck actively probes every target of a route, a target is taken out of rotation after UnhealthyThreshold
+// consecutive failed probes and put back after HealthyThreshold consecutive successful ones.
+type HealthCheck struct {
+	Path               string   `json:"path"`
+	ExpectedStatus     int      `json:"expected_status,omitempty"`     // default 200
+	Interval           Duration `json:"interval,omitempty"`            // default 10s
+	Timeout            Duration `json:"timeout,omitempty"`             // default 2s
+	HealthyThreshold   int      `json:"healthy_threshold,omitempty"`   // default 2
+	UnhealthyThreshold int      `json:"unhealthy_threshold,omitempty"` // default 3
+}
+
+// PassiveHealth ejects a target from rotation for EjectDuration after MaxFails consecutive proxy errors.
+type PassiveHealth struct {
+	MaxFails      int      `json:"max_fails,omitempty"`      // default 5
+	EjectDuration Duration `json:"eject_duration,omitempty"` // default 30s
+}
+
+// UpstreamStatus is a snapshot of the health of a route target.
+type UpstreamStatus struct {
+	Host              string     `json:"host,omitempty"`
+	Prefix            string     `json:"prefix"`
+	Target            string     `json:"target"`
+	Healthy           bool       `json:"healthy"`
+	EjectedUntil      *time.Time `json:"ejected_until,omitempty"`
+	ActiveConnections int64      `json:"active_connections"`
+	LastError         string     `json:"last_error,omitempty"`
+	LastCheck         *time.Time `json:"last_check,omitempty"`
+}
+
+type health struct {
+	mu                  sync.Mutex
+	successes           int
+	failures            int
+	consecutiveErrors   int
+	ejectedUntil        time.Time
+	lastError           string
+	lastCheck           time.Time
+	unhealthyThreshold  int
+	healthyThreshold    int
+	passiveMaxFails     int
+	passiveEjectionTime time.Duration
+}
+
+func (u *upstream) available() bool {
+	if !u.healthy.Load() {
+		return false
+	}
+	u.health.mu.Lock()
+	defer u.health.mu.Unlock()
+	return time.Now().After(u.health.ejectedUntil)
+}
+
+// recordCheck records the result of an active health check, toggling the health state on reaching a threshold.
+func (u *upstream) recordCheck(err error) {
+	h := &u.health
+	h.mu.Lock()
+	h.lastCheck = time.Now()
+	changed := false
+	if err != nil {
+		h.lastError = err.Error()
+		h.successes = 0
+		h.failures++
+		if h.failures >= h.unhealthyThreshold && u.healthy.Load() {
+			u.healthy.Store(false)
+			changed = true
+		}
+	} else {
+		h.lastError = ""
+		h.failures = 0
+		h.successes++
+		if h.successes >= h.healthyThreshold && !u.healthy.Load() {
+			u.healthy.Store(true)
+			changed = true
+		}
+	}
+	h.mu.Unlock()
+	if changed {
+		log.New().
+			WithField("target", u.target.String()).
+			WithField("healthy", u.healthy.Load()).
+			WithError(err).
+			Info("upstream health changed")
+	}
+}
+
+// recordProxyResult records the outcome of a proxied request, ejecting the upstream on too many consecutive errors.
+func (u *upstream) recordProxyResult(err error) {
+	h := &u.health
+	h.mu.Lock()
+	if err == nil {
+		h.consecutiveErrors = 0
+		h.mu.Unlock()
+		return
+	}
+	h.consecutiveErrors++
+	h.lastError = err.Error()
+	if h.passiveMaxFails <= 0 || h.consecutiveErrors < h.passiveMaxFails {
+		h.mu.Unlock()
+		return
+	}
+	h.consecutiveErrors = 0
+	h.ejectedUntil = time.Now().Add(h.passiveEjectionTime)
+	ejectedUntil := h.ejectedUntil
+	h.mu.Unlock()
+	log.New().
+		WithField("target", u.target.String()).
+		WithField("ejected_until", ejectedUntil.Format(time.RFC3339)).
+		WithError(err).
+		Info("upstream ejected after consecutive proxy errors")
+}
+
+func (u *upstream) status(r Route) UpstreamStatus {
+	u.health.mu.Lock()
+	defer u.health.mu.Unlock()
+	s := UpstreamStatus{
+		Host:              r.Host,
+		Prefix:            r.Prefix,
+		Target:            u.target.String(),
+		Healthy:           u.healthy.Load() && time.Now().After(u.health.ejectedUntil),
+		ActiveConnections: u.active.Load(),
+		LastError:         u.health.lastError,
+	}
+	if time.Now().Before(u.health.ejectedUntil) {
+		t := u.health.ejectedUntil
+		s.EjectedUntil = &t
+	}
+	if !u.health.lastCheck.IsZero() {
+		t := u.health.lastCheck
+		s.LastCheck = &t
+	}
+	return s
+}
+
+func (p *pool) configureHealth(r Route) {
+	for _, u := range p.upstreams {
+		u.health.healthyThreshold = 2
+		u.health.unhealthyThreshold = 3
+		if r.HealthCheck != nil && r.HealthCheck.HealthyThreshold > 0 {
+			u.health.healthyThreshold = r.HealthCheck.HealthyThreshold
+		}
+		if r.HealthCheck != nil && r.HealthCheck.UnhealthyThreshold > 0 {
+			u.health.unhealthyThreshold = r.HealthCheck.UnhealthyThreshold
+		}
+		if r.PassiveHealth != nil {
+			u.health.passiveMaxFails = 5
+			if r.PassiveHealth.MaxFails > 0 {
+				u.health.passiveMaxFails = r.PassiveHealth.MaxFails
+			}
+			u.health.passiveEjectionTime = r.PassiveHealth.EjectDuration.or(30 * time.Second)
+		}
+	}
+}
+
+// checkHealth probes all upstreams of the pool every interval until ctx is done.
+func (p *pool) checkHealth(ctx context.Context, hc HealthCheck, client *http.Client) {
+	interval := hc.Interval.or(10 * time.Second)
+	timeout := hc.Timeout.or(2 * time.Second)
+	expectedStatus := hc.ExpectedStatus
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+	check := func(u *upstream) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		u.recordCheck(probe(ctx, client, healthCheckUrl(u.target, hc.Path), expectedStatus))
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, u := range p.upstreams {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				check(u)
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func probe(ctx context.Context, client *http.Client, url string, expectedStatus int) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		return fmt.Errorf("health check status %d, expected %d", resp.StatusCode, expectedStatus)
+	}
+	return nil
+}
+
+func healthCheckUrl(target *url.URL, checkPath string) string {
+	u := *target
+	u.Path = path.Join("/", target.Path, checkPath)
+	u.RawPath = ""
+	u.RawQuery = ""
+	return u.String()
+}
@@ -0,0 +1,99 @@
+package epoxy
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// hostRouter dispatches requests on the Host header first, and then on path using the mux of the matching host.
+// Requests not matched by any path of a host specific mux fall through to the default mux.
+type hostRouter struct {
+	exact    map[string]*http.ServeMux
+	wildcard []wildcardMux
+	fallback *http.ServeMux
+}
+
+type wildcardMux struct {
+	suffix string
+	mux    *http.ServeMux
+}
+
+func newHostRouter() *hostRouter {
+	return &hostRouter{
+		exact:    make(map[string]*http.ServeMux),
+		fallback: http.NewServeMux(),
+	}
+}
+
+// mux returns the mux for the host pattern, creating it if needed.
+// Host patterns are either empty (default), an exact host e.g. "app.example.com" or a wildcard e.g. "*.example.com".
+func (h *hostRouter) mux(pattern string) *http.ServeMux {
+	pattern = normalizeHost(pattern)
+	if pattern == "" {
+		return h.fallback
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := strings.TrimPrefix(pattern, "*")
+		for _, w := range h.wildcard {
+			if w.suffix == suffix {
+				return w.mux
+			}
+		}
+		m := http.NewServeMux()
+		h.wildcard = append(h.wildcard, wildcardMux{suffix: suffix, mux: m})
+		// most specific wildcard first
+		sort.SliceStable(h.wildcard, func(i, j int) bool {
+			return len(h.wildcard[i].suffix) > len(h.wildcard[j].suffix)
+		})
+		return m
+	}
+	m, ok := h.exact[pattern]
+	if !ok {
+		m = http.NewServeMux()
+		h.exact[pattern] = m
+	}
+	return m
+}
+
+func (h *hostRouter) lookup(host string) *http.ServeMux {
+	host = normalizeHost(host)
+	if m, ok := h.exact[host]; ok {
+		return m
+	}
+	for _, w := range h.wildcard {
+		if strings.HasSuffix(host, w.suffix) {
+			return w.mux
+		}
+	}
+	return nil
+}
+
+// handler returns the handler r is served by, and the pattern it matched, empty if none did.
+func (h *hostRouter) handler(r *http.Request) (http.Handler, string) {
+	if m := h.lookup(r.Host); m != nil {
+		if handler, pattern := m.Handler(r); pattern != "" {
+			return handler, pattern
+		}
+	}
+	return h.fallback.Handler(r)
+}
+
+func (h *hostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m := h.lookup(r.Host); m != nil {
+		if handler, pattern := m.Handler(r); pattern != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	h.fallback.ServeHTTP(w, r)
+}
+
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(host, ".")
+}
@@ -0,0 +1,52 @@
+package epoxy
+
+import (
+	"context"
+	"strings"
+)
+
+// Identity types.
+const (
+	IdentityUser    = "user"
+	IdentityService = "service"
+	IdentityDev     = "dev"
+)
+
+// Identity is the authenticated identity of a request, set by the authenticating middleware of a server mode and
+// matched against the access rules of routes. Users of the package authenticating requests themselves set it with
+// WithIdentity.
+type Identity struct {
+	Type       string
+	Email      string
+	CommonName string // client id, for service identities
+	Country    string
+	Claims     map[string]any // claims of the authenticating token
+	Ext        map[string]any // claims fetched by extjwt, if any
+}
+
+type identityContextKey struct{}
+
+// WithIdentity returns ctx carrying the authenticated identity id.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, id)
+}
+
+// IdentityFromContext returns the identity of the request, which is modifiable by later middlewares e.g. to add Ext
+// claims.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityContextKey{}).(*Identity)
+	return id, ok && id != nil
+}
+
+// LookupClaim returns the value at a dot separated path in claims, e.g. "user.groups", or nil if not found.
+func LookupClaim(claims map[string]any, path string) any {
+	var v any = claims
+	for _, p := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[p]
+	}
+	return v
+}
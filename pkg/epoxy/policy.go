@@ -0,0 +1,91 @@
+package epoxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// AccessRule matches an identity if all of its non-empty conditions match. A route with access rules only allows
+// identities matching at least one of them.
+type AccessRule struct {
+	Emails        []string            `json:"emails,omitempty"`
+	EmailDomains  []string            `json:"email_domains,omitempty"`
+	Countries     []string            `json:"countries,omitempty"`
+	IdentityTypes []string            `json:"identity_types,omitempty"` // user, service or dev
+	ServiceTokens []string            `json:"service_tokens,omitempty"` // client ids (common_name) of service tokens
+	Claims        map[string][]string `json:"claims,omitempty"`         // dot separated path in the Cloudflare claims to accepted values
+	ExtClaims     map[string][]string `json:"ext_claims,omitempty"`     // dot separated path in the extjwt claims to accepted values
+}
+
+// authorize returns the reason for denying r access to the route, or nil if access is allowed.
+func (r Route) authorize(req *http.Request) error {
+	if len(r.Access) == 0 {
+		return nil
+	}
+	id, ok := IdentityFromContext(req.Context())
+	if !ok {
+		return errors.New("no authenticated identity")
+	}
+	var reasons []string
+	for i, rule := range r.Access {
+		err := rule.match(id)
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, fmt.Sprintf("rule %d: %s", i, err.Error()))
+	}
+	return errors.New(strings.Join(reasons, "; "))
+}
+
+func (a AccessRule) match(id *Identity) error {
+	email := strings.ToLower(id.Email)
+	if len(a.Emails) > 0 && !slices.ContainsFunc(a.Emails, func(e string) bool { return strings.EqualFold(e, email) }) {
+		return errors.New("email not allowed")
+	}
+	if len(a.EmailDomains) > 0 {
+		_, domain, _ := strings.Cut(email, "@")
+		if !slices.ContainsFunc(a.EmailDomains, func(d string) bool { return strings.EqualFold(strings.TrimPrefix(d, "@"), domain) }) {
+			return errors.New("email domain not allowed")
+		}
+	}
+	if len(a.Countries) > 0 && !slices.ContainsFunc(a.Countries, func(c string) bool { return strings.EqualFold(c, id.Country) }) {
+		return errors.New("country not allowed")
+	}
+	if len(a.IdentityTypes) > 0 && !slices.Contains(a.IdentityTypes, id.Type) {
+		return errors.New("identity type not allowed")
+	}
+	if len(a.ServiceTokens) > 0 && (id.Type != IdentityService || !slices.Contains(a.ServiceTokens, id.CommonName)) {
+		return errors.New("service token not allowed")
+	}
+	for path, values := range a.Claims {
+		if !claimMatches(LookupClaim(id.Claims, path), values) {
+			return fmt.Errorf("claim '%s' not matching", path)
+		}
+	}
+	for path, values := range a.ExtClaims {
+		if !claimMatches(LookupClaim(id.Ext, path), values) {
+			return fmt.Errorf("ext claim '%s' not matching", path)
+		}
+	}
+	return nil
+}
+
+// claimMatches reports if claim, a single value or an array of values, contains any of values.
+func claimMatches(claim any, values []string) bool {
+	switch c := claim.(type) {
+	case []any:
+		for _, v := range c {
+			if claimMatches(v, values) {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	default:
+		return slices.Contains(values, fmt.Sprint(c))
+	}
+}
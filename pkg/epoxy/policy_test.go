@@ -0,0 +1,149 @@
+package epoxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// claims decodes JSON, so values have the types of decoded tokens.
+func claims(t *testing.T, s string) map[string]any {
+	t.Helper()
+	var c map[string]any
+	if err := json.Unmarshal([]byte(s), &c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClaimMatches(t *testing.T) {
+	c := claims(t, `{
+		"role": "admin",
+		"level": 3,
+		"verified": true,
+		"groups": ["dev", "ops"],
+		"empty": [],
+		"null": null,
+		"user": {"org": {"id": "acme", "teams": ["a", "b"]}, "groups": ["x"]},
+		"nested": [["deep"]]
+	}`)
+	for _, tc := range []struct {
+		path    string
+		values  []string
+		matches bool
+	}{
+		{path: "role", values: []string{"admin"}, matches: true},
+		{path: "role", values: []string{"user", "admin"}, matches: true},
+		{path: "role", values: []string{"Admin"}},
+		{path: "level", values: []string{"3"}, matches: true},
+		{path: "verified", values: []string{"true"}, matches: true},
+		{path: "groups", values: []string{"ops"}, matches: true},
+		{path: "groups", values: []string{"qa", "dev"}, matches: true},
+		{path: "groups", values: []string{"qa"}},
+		{path: "empty", values: []string{""}},
+		{path: "null", values: []string{"", "<nil>"}},
+		{path: "user.org.id", values: []string{"acme"}, matches: true},
+		{path: "user.org.teams", values: []string{"b"}, matches: true},
+		{path: "user.groups", values: []string{"x"}, matches: true},
+		{path: "user.org", values: []string{"acme"}},
+		{path: "user.org.id.x", values: []string{"acme"}},
+		{path: "nested", values: []string{"deep"}, matches: true},
+		{path: "missing", values: []string{""}},
+		{path: "user.missing", values: []string{""}},
+		{path: "missing.role", values: []string{"admin"}},
+		{path: "role", values: nil},
+	} {
+		if matches := claimMatches(LookupClaim(c, tc.path), tc.values); matches != tc.matches {
+			t.Errorf("%s %v: expected %t, got %t", tc.path, tc.values, tc.matches, matches)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	admin := &Identity{Type: IdentityUser, Email: "alice@example.com", Claims: claims(t, `{"groups": ["admin"], "org": {"id": "acme"}}`)}
+	user := &Identity{Type: IdentityUser, Email: "bob@example.com", Claims: claims(t, `{"groups": ["dev"], "org": {"id": "acme"}}`)}
+	noClaims := &Identity{Type: IdentityUser, Email: "carol@example.com"}
+	ci := &Identity{Type: IdentityService, CommonName: "ci.access", Claims: claims(t, `{"common_name": "ci.access"}`)}
+	deploy := &Identity{Type: IdentityService, CommonName: "deploy.access", Claims: claims(t, `{"common_name": "deploy.access", "env": "prod"}`)}
+	// a user identity with a common name of a service token, e.g. from a crafted token, is no service
+	impostor := &Identity{Type: IdentityUser, Email: "eve@example.com", CommonName: "ci.access"}
+
+	for _, tc := range []struct {
+		name    string
+		access  []AccessRule
+		allowed []*Identity
+		denied  []*Identity
+	}{
+		{
+			name:    "no rules",
+			allowed: []*Identity{admin, user, noClaims, ci, nil},
+		},
+		{
+			name:    "array claim",
+			access:  []AccessRule{{Claims: map[string][]string{"groups": {"admin"}}}},
+			allowed: []*Identity{admin},
+			denied:  []*Identity{user, noClaims, ci, nil},
+		},
+		{
+			name:    "nested claim",
+			access:  []AccessRule{{Claims: map[string][]string{"org.id": {"acme"}}}},
+			allowed: []*Identity{admin, user},
+			denied:  []*Identity{noClaims, ci},
+		},
+		{
+			name:    "all claims of a rule",
+			access:  []AccessRule{{Claims: map[string][]string{"org.id": {"acme"}, "groups": {"dev"}}}},
+			allowed: []*Identity{user},
+			denied:  []*Identity{admin, noClaims},
+		},
+		{
+			name:    "service tokens",
+			access:  []AccessRule{{ServiceTokens: []string{"ci.access"}}},
+			allowed: []*Identity{ci},
+			denied:  []*Identity{deploy, impostor, admin},
+		},
+		{
+			name:    "service tokens and claims in one rule",
+			access:  []AccessRule{{ServiceTokens: []string{"ci.access", "deploy.access"}, Claims: map[string][]string{"env": {"prod"}}}},
+			allowed: []*Identity{deploy},
+			denied:  []*Identity{ci, impostor, admin},
+		},
+		{
+			name: "service tokens or claims in separate rules",
+			access: []AccessRule{
+				{ServiceTokens: []string{"ci.access"}},
+				{Claims: map[string][]string{"groups": {"admin"}}},
+			},
+			allowed: []*Identity{ci, admin},
+			denied:  []*Identity{deploy, user, impostor, noClaims},
+		},
+		{
+			name:    "ext claims",
+			access:  []AccessRule{{ExtClaims: map[string][]string{"groups": {"admin"}}}},
+			allowed: []*Identity{{Type: IdentityUser, Ext: claims(t, `{"groups": ["admin"]}`)}},
+			denied:  []*Identity{admin, noClaims},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			route := Route{Prefix: "/", Access: tc.access}
+			authorize := func(id *Identity) error {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				if id != nil {
+					req = req.WithContext(WithIdentity(req.Context(), id))
+				}
+				return route.authorize(req)
+			}
+			for _, id := range tc.allowed {
+				if err := authorize(id); err != nil {
+					t.Errorf("%+v: expected access, got %v", id, err)
+				}
+			}
+			for _, id := range tc.denied {
+				if err := authorize(id); err == nil {
+					t.Errorf("%+v: expected access denied", id)
+				}
+			}
+		})
+	}
+}
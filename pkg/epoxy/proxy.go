@@ -0,0 +1,174 @@
+package epoxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/modfin/epoxy/internal/errorpage"
+	"github.com/modfin/epoxy/internal/log"
+)
+
+type routeHandler struct {
+	route   Route
+	pool    *pool
+	proxy   *httputil.ReverseProxy
+	client  *http.Client
+	breaker *circuitBreaker
+}
+
+// attempt holds the outcome of proxying a request to a single upstream.
+type attempt struct {
+	err    error
+	status int
+}
+
+type attemptContextKey struct{}
+
+func newRouteHandler(r Route) (*routeHandler, error) {
+	p, err := newPool(r)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newTransport(r)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			upstreamFromContext(req.Context()).director(req)
+		},
+	}
+
+	// attempt to fix issue with Host header NOT being set to target host on reverse proxy
+	if r.RewriteHost {
+		proxy = &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(upstreamFromContext(pr.In.Context()).target)
+			},
+		}
+	}
+	proxy.Transport = transport
+	proxy.FlushInterval = time.Duration(r.FlushInterval)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		upstreamFromContext(resp.Request.Context()).recordProxyResult(nil)
+		if a, ok := resp.Request.Context().Value(attemptContextKey{}).(*attempt); ok {
+			a.status = resp.StatusCode
+		}
+		return nil
+	}
+	// errors are recorded and answered by routeHandler, once it is decided the client is still there and not to retry
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		if a, ok := req.Context().Value(attemptContextKey{}).(*attempt); ok {
+			a.err = err
+		}
+	}
+
+	return &routeHandler{
+		route:   r,
+		pool:    p,
+		proxy:   proxy,
+		client:  &http.Client{Transport: transport, CheckRedirect: noRedirect},
+		breaker: newCircuitBreaker(r.CircuitBreaker),
+	}, nil
+}
+
+func (h *routeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.route.authorize(r); err != nil {
+		log.New().WithField("access_denied", err.Error()).AddToContext(r.Context())
+		errorpage.Write(w, r, http.StatusForbidden)
+		return
+	}
+
+	allowed, circuit := h.breaker.allow()
+	if h.breaker != nil {
+		log.New().WithField("circuit", circuit).AddToContext(r.Context())
+	}
+	if !allowed {
+		log.New().WithError(errors.New("epoxy: circuit open, failing fast")).AddToContext(r.Context())
+		errorpage.Write(w, r, http.StatusServiceUnavailable)
+		return
+	}
+
+	var uw *upgradeWriter
+	if IsUpgrade(r) {
+		uw = &upgradeWriter{ResponseWriter: w, limits: h.route.Upgrade}
+		w = uw
+		log.New().WithField("upgrade", r.Header.Get("Upgrade")).AddToContext(r.Context())
+	}
+
+	ctx := r.Context()
+	// the request context is bound to upgraded connections, so they are only limited by UpgradeLimits
+	if h.route.Timeouts != nil && h.route.Timeouts.Request > 0 && uw == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(h.route.Timeouts.Request))
+		defer cancel()
+	}
+
+	var retries int
+	if h.route.Retry != nil {
+		retries = h.route.Retry.Attempts
+	}
+	var tried []*upstream
+	for {
+		u := h.pool.next(r, tried...)
+		if u == nil {
+			h.breaker.record(false)
+			log.New().WithError(errors.New("epoxy: no healthy upstream")).AddToContext(r.Context())
+			errorpage.Write(w, r, http.StatusServiceUnavailable)
+			return
+		}
+		tried = append(tried, u)
+		log.New().WithField("upstream", u.target.String()).AddToContext(r.Context())
+
+		a := &attempt{}
+		u.active.Add(1)
+		h.proxy.ServeHTTP(w, r.WithContext(context.WithValue(withUpstream(ctx, u), attemptContextKey{}, a)))
+		u.active.Add(-1)
+		if uw != nil && uw.conn != nil {
+			log.New().WithFields(uw.conn.logFields()).AddToContext(r.Context())
+		}
+
+		if a.err == nil {
+			if h.breaker.record(a.status < http.StatusInternalServerError) {
+				log.New().WithField("circuit", circuitOpen).AddToContext(r.Context())
+			}
+			return
+		}
+		if r.Context().Err() != nil {
+			// the client went away, e.g. navigated away from a slow page, which says nothing about the upstream
+			if circuit == circuitHalfOpen {
+				h.breaker.release()
+			}
+			log.New().WithField("client_gone", true).WithError(fmt.Errorf("epoxy: proxy error: %w", a.err)).AddToContext(r.Context())
+			return
+		}
+		u.recordProxyResult(a.err)
+		if len(tried) <= retries && ctx.Err() == nil && isRetryable(r, a.err) {
+			log.New().
+				WithField("retries", len(tried)).
+				WithField("retry_reason", a.err.Error()).
+				AddToContext(r.Context())
+			continue
+		}
+		if h.breaker.record(false) {
+			log.New().WithField("circuit", circuitOpen).AddToContext(r.Context())
+		}
+		if isTimeout(a.err) {
+			log.New().WithField("timeout", true).WithError(fmt.Errorf("epoxy: proxy timeout: %w", a.err)).AddToContext(r.Context())
+			errorpage.Write(w, r, http.StatusGatewayTimeout)
+			return
+		}
+		log.New().WithError(fmt.Errorf("epoxy: proxy error: %w", a.err)).AddToContext(r.Context())
+		errorpage.Write(w, r, http.StatusBadGateway)
+		return
+	}
+}
+
+// noRedirect makes health probes report the status of the upstream itself, rather than of where it redirects to.
+func noRedirect(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
@@ -0,0 +1,134 @@
+package epoxy
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/modfin/epoxy/internal/log"
+)
+
+// streamingUpstream writes a first line with contentType, and the second line only after release is closed.
+func streamingUpstream(contentType string, release chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write([]byte("data: 1\n\n"))
+		_ = http.NewResponseController(w).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		_, _ = w.Write([]byte("data: 2\n\n"))
+	}))
+}
+
+// firstLine returns the first line of the response to a request to proxy, or false if it doesn't arrive within timeout.
+func firstLine(t *testing.T, proxy *httptest.Server, accept string, timeout time.Duration) (string, bool) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/stream", nil)
+	req.Header.Set("Accept", accept)
+	resp, err := proxy.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		return line, true
+	case <-time.After(timeout):
+		return "", false
+	}
+}
+
+func TestFlushServerSentEvents(t *testing.T) {
+	release := make(chan struct{})
+	upstream := streamingUpstream("text/event-stream", release)
+	defer upstream.Close()
+	proxy := newTestProxy(t, Route{Prefix: "/stream", Target: upstream.URL})
+	defer proxy.Close()
+	defer close(release)
+
+	line, ok := firstLine(t, proxy, "text/event-stream", time.Second)
+	if !ok || line != "data: 1\n" {
+		t.Fatalf("expected first event before the upstream is done, got %q %v", line, ok)
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		flushInterval Duration
+	}{
+		{name: "immediate", flushInterval: Duration(-1)},
+		{name: "periodic", flushInterval: Duration(50 * time.Millisecond)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			release := make(chan struct{})
+			upstream := streamingUpstream("application/x-ndjson", release)
+			defer upstream.Close()
+			proxy := newTestProxy(t, Route{Prefix: "/stream", Target: upstream.URL, FlushInterval: tc.flushInterval})
+			defer proxy.Close()
+			defer close(release)
+
+			line, ok := firstLine(t, proxy, "application/x-ndjson", time.Second)
+			if !ok || line != "data: 1\n" {
+				t.Fatalf("expected first line before the upstream is done, got %q %v", line, ok)
+			}
+		})
+	}
+}
+
+func TestClientGone(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+	e, err := NewWithSites(nil, Route{
+		Prefix:         "/slow",
+		Target:         upstream.URL,
+		PassiveHealth:  &PassiveHealth{MaxFails: 1},
+		CircuitBreaker: &CircuitBreaker{Failures: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rh := e.(*epoxy).routes.handlers[0]
+	proxy := httptest.NewServer(log.Middleware(e.(*epoxy)))
+	defer proxy.Close()
+	defer close(release)
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, proxy.URL+"/slow", nil)
+		_, err := proxy.Client().Do(req)
+		cancel()
+		if err == nil {
+			t.Fatal("expected the client to give up")
+		}
+	}
+	u := rh.pool.upstreams[0]
+	for start := time.Now(); u.active.Load() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("proxied requests not done")
+		}
+	}
+	if !u.available() {
+		t.Error("expected upstream not to be ejected when clients go away")
+	}
+	if allowed, circuit := rh.breaker.allow(); !allowed || circuit != circuitClosed {
+		t.Errorf("expected circuit to stay closed when clients go away, got %s", circuit)
+	}
+}
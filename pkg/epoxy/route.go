@@ -1,8 +1,46 @@
 package epoxy
 
+import "io/fs"
+
 type Route struct {
-	Prefix      string `json:"prefix"`
-	Target      string `json:"target"`
-	Strip       bool   `json:"strip,omitempty"`
-	RewriteHost bool   `json:"rewrite_host,omitempty"`
+	Host        string   `json:"host,omitempty"`
+	Prefix      string   `json:"prefix"`
+	Target      string   `json:"target,omitempty"`
+	Targets     []string `json:"targets,omitempty"`
+	Balance     string   `json:"balance,omitempty"`  // round_robin (default), least_conn, random or hash
+	HashKey     string   `json:"hash_key,omitempty"` // header:<name> or cookie:<name>, used by hash balancing
+	Strip       bool     `json:"strip,omitempty"`
+	RewriteHost bool     `json:"rewrite_host,omitempty"`
+
+	HealthCheck   *HealthCheck   `json:"health_check,omitempty"`
+	PassiveHealth *PassiveHealth `json:"passive_health,omitempty"`
+
+	Timeouts       *Timeouts       `json:"timeouts,omitempty"`
+	Retry          *Retry          `json:"retry,omitempty"`
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker,omitempty"`
+
+	TLS *UpstreamTLS `json:"tls,omitempty"`
+
+	FlushInterval Duration       `json:"flush_interval,omitempty"` // negative flushes after every write, see httputil.ReverseProxy
+	Upgrade       *UpgradeLimits `json:"upgrade,omitempty"`
+
+	Access []AccessRule `json:"access,omitempty"`
+
+	TokenAudience string `json:"token_audience,omitempty"` // aud of the Epoxy-Token issued for requests to the route
+}
+
+func (r Route) targets() []string {
+	var targets []string
+	if r.Target != "" {
+		targets = append(targets, r.Target)
+	}
+	return append(targets, r.Targets...)
+}
+
+// Site is a directory of static files, served at Prefix for Host.
+// Host is either empty (any host), an exact host e.g. "app.example.com" or a wildcard e.g. "*.example.com".
+type Site struct {
+	Host   string
+	Dir    fs.FS
+	Prefix string
 }
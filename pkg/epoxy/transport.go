@@ -0,0 +1,65 @@
+package epoxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Timeouts of requests proxied to the targets of a route, zero means no timeout besides the defaults of
+// http.DefaultTransport.
+type Timeouts struct {
+	Dial           Duration `json:"dial,omitempty"`
+	ResponseHeader Duration `json:"response_header,omitempty"`
+	Request        Duration `json:"request,omitempty"` // deadline for the whole request, including retries
+}
+
+// Retry of idempotent requests without body, on failure to connect to a target. Each attempt picks another target.
+type Retry struct {
+	Attempts int `json:"attempts"`
+}
+
+func newTransport(r Route) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if r.TLS != nil {
+		c, err := r.TLS.config()
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = c
+	}
+	if r.Timeouts != nil && r.Timeouts.Dial > 0 {
+		dialer := &net.Dialer{
+			Timeout:   time.Duration(r.Timeouts.Dial),
+			KeepAlive: 30 * time.Second,
+		}
+		t.DialContext = dialer.DialContext
+	}
+	if r.Timeouts != nil && r.Timeouts.ResponseHeader > 0 {
+		t.ResponseHeaderTimeout = time.Duration(r.Timeouts.ResponseHeader)
+	}
+	return t, nil
+}
+
+func isRetryable(r *http.Request, err error) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+	default:
+		return false
+	}
+	if r.ContentLength != 0 || (r.Body != nil && r.Body != http.NoBody) {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
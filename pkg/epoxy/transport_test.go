@@ -0,0 +1,68 @@
+package epoxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIsRetryable(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	for _, tc := range []struct {
+		name      string
+		method    string
+		body      string
+		err       error
+		retryable bool
+	}{
+		{name: "get dial", method: http.MethodGet, err: dialErr, retryable: true},
+		{name: "get wrapped dial", method: http.MethodGet, err: fmt.Errorf("proxy: %w", dialErr), retryable: true},
+		{name: "head dial", method: http.MethodHead, err: dialErr, retryable: true},
+		{name: "put dial", method: http.MethodPut, err: dialErr, retryable: true},
+		{name: "delete dial", method: http.MethodDelete, err: dialErr, retryable: true},
+		{name: "post dial", method: http.MethodPost, err: dialErr},
+		{name: "patch dial", method: http.MethodPatch, err: dialErr},
+		{name: "put with body", method: http.MethodPut, body: "x", err: dialErr},
+		{name: "get read", method: http.MethodGet, err: &net.OpError{Op: "read", Err: errors.New("connection reset")}},
+		{name: "get timeout", method: http.MethodGet, err: context.DeadlineExceeded},
+		{name: "get other", method: http.MethodGet, err: errors.New("other")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/", nil)
+			if tc.body != "" {
+				r = httptest.NewRequest(tc.method, "/", strings.NewReader(tc.body))
+			}
+			if retryable := isRetryable(r, tc.err); retryable != tc.retryable {
+				t.Errorf("expected retryable %t, got %t", tc.retryable, retryable)
+			}
+		})
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		err     error
+		timeout bool
+	}{
+		{name: "deadline", err: context.DeadlineExceeded, timeout: true},
+		{name: "wrapped deadline", err: fmt.Errorf("proxy: %w", context.DeadlineExceeded), timeout: true},
+		{name: "net timeout", err: &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, timeout: true},
+		{name: "dns timeout", err: &net.DNSError{IsTimeout: true}, timeout: true},
+		{name: "canceled", err: context.Canceled},
+		{name: "dial refused", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}},
+		{name: "other", err: errors.New("other")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if timeout := isTimeout(tc.err); timeout != tc.timeout {
+				t.Errorf("expected timeout %t, got %t", tc.timeout, timeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package epoxy
+
+import (
+	"bufio"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UpgradeLimits limits connections upgraded to another protocol e.g. WebSockets, zero means no limit.
+type UpgradeLimits struct {
+	IdleTimeout Duration `json:"idle_timeout,omitempty"` // closes the connection after no data in either direction
+	MaxLifetime Duration `json:"max_lifetime,omitempty"`
+}
+
+// IsUpgrade reports if r requests to upgrade the connection to another protocol, e.g. WebSockets.
+func IsUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsStreaming reports if r is an upgrade request or requests Server-Sent Events, responses to such requests
+// must be passed through unbuffered.
+func IsStreaming(r *http.Request) bool {
+	return IsUpgrade(r) || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// IsStreamingContentType reports if a response with content type ct is streamed, e.g. Server-Sent Events sent
+// without the request asking for them, and must be passed through unbuffered.
+func IsStreamingContentType(ct string) bool {
+	mediaType, _, _ := mime.ParseMediaType(ct)
+	return strings.EqualFold(mediaType, "text/event-stream")
+}
+
+// upgradeWriter wraps the connection hijacked by httputil.ReverseProxy on protocol switch, enforcing limits and
+// counting bytes.
+type upgradeWriter struct {
+	http.ResponseWriter
+	limits *UpgradeLimits
+	conn   *trackedConn
+}
+
+func (w *upgradeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = newTrackedConn(conn, w.limits)
+	return w.conn, brw, nil
+}
+
+func (w *upgradeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type trackedConn struct {
+	net.Conn
+	start        time.Time
+	lastActivity atomic.Int64
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	closeReason  atomic.Value
+	closeOnce    sync.Once
+	done         chan struct{}
+}
+
+func newTrackedConn(conn net.Conn, limits *UpgradeLimits) *trackedConn {
+	c := &trackedConn{
+		Conn:  conn,
+		start: time.Now(),
+		done:  make(chan struct{}),
+	}
+	c.lastActivity.Store(c.start.UnixNano())
+	if limits != nil && (limits.IdleTimeout > 0 || limits.MaxLifetime > 0) {
+		go c.enforce(time.Duration(limits.IdleTimeout), time.Duration(limits.MaxLifetime))
+	}
+	return c
+}
+
+func (c *trackedConn) enforce(idleTimeout time.Duration, maxLifetime time.Duration) {
+	interval := time.Second
+	for _, d := range []time.Duration{idleTimeout, maxLifetime} {
+		if d > 0 && d/2 < interval {
+			interval = max(d/2, time.Millisecond)
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			if maxLifetime > 0 && now.Sub(c.start) >= maxLifetime {
+				c.closeWithReason("max lifetime reached")
+				return
+			}
+			if idleTimeout > 0 && now.Sub(time.Unix(0, c.lastActivity.Load())) >= idleTimeout {
+				c.closeWithReason("idle timeout")
+				return
+			}
+		}
+	}
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.bytesIn.Add(int64(n))
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.bytesOut.Add(int64(n))
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// CloseWrite is used by httputil.ReverseProxy to half close the connection when the backend is done sending.
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("close write not supported")
+}
+
+func (c *trackedConn) closeWithReason(reason string) {
+	c.closeReason.CompareAndSwap(nil, reason)
+	_ = c.Close()
+}
+
+func (c *trackedConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.closeReason.CompareAndSwap(nil, "closed")
+		close(c.done)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+func (c *trackedConn) logFields() map[string]any {
+	reason, _ := c.closeReason.Load().(string)
+	return map[string]any{
+		"status":            http.StatusSwitchingProtocols,
+		"upgrade_duration":  time.Since(c.start).String(),
+		"upgrade_bytes_in":  c.bytesIn.Load(),
+		"upgrade_bytes_out": c.bytesOut.Load(),
+		"upgrade_close":     reason,
+	}
+}
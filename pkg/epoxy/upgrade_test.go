@@ -0,0 +1,153 @@
+package epoxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/modfin/epoxy/internal/log"
+)
+
+// echoUpgrade is an upstream switching to an echo protocol on upgrade requests.
+func echoUpgrade(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsUpgrade(r) {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = brw.Flush()
+		_, _ = io.Copy(conn, brw)
+	}))
+}
+
+func newTestProxy(t *testing.T, route Route) *httptest.Server {
+	t.Helper()
+	e, err := NewWithSites(nil, route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(log.Middleware(e.(*epoxy)))
+}
+
+// dialUpgrade sends an upgrade request through the proxy, and returns the upgraded connection.
+func dialUpgrade(t *testing.T, proxy *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	return conn, br
+}
+
+func echo(t *testing.T, conn net.Conn, br *bufio.Reader, msg string) {
+	t.Helper()
+	_, err := io.WriteString(conn, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len(msg))
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadFull(br, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != msg {
+		t.Fatalf("expected %q, got %q", msg, b)
+	}
+}
+
+// expectClosed waits for the proxy to close conn, failing if it is not closed within timeout.
+func expectClosed(t *testing.T, conn net.Conn, br *bufio.Reader, timeout time.Duration) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := br.ReadByte()
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("connection not closed within %s", timeout)
+	}
+	if err == nil {
+		t.Fatal("expected connection to be closed")
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	upstream := echoUpgrade(t)
+	defer upstream.Close()
+	proxy := newTestProxy(t, Route{Prefix: "/ws", Target: upstream.URL})
+	defer proxy.Close()
+
+	conn, br := dialUpgrade(t, proxy)
+	echo(t, conn, br, "ping")
+	echo(t, conn, br, "pong")
+}
+
+func TestUpgradeIdleTimeout(t *testing.T) {
+	upstream := echoUpgrade(t)
+	defer upstream.Close()
+	proxy := newTestProxy(t, Route{
+		Prefix:  "/ws",
+		Target:  upstream.URL,
+		Upgrade: &UpgradeLimits{IdleTimeout: Duration(200 * time.Millisecond)},
+	})
+	defer proxy.Close()
+
+	conn, br := dialUpgrade(t, proxy)
+	echo(t, conn, br, "ping")
+	expectClosed(t, conn, br, 2*time.Second)
+}
+
+func TestUpgradeMaxLifetime(t *testing.T) {
+	upstream := echoUpgrade(t)
+	defer upstream.Close()
+	proxy := newTestProxy(t, Route{
+		Prefix:  "/ws",
+		Target:  upstream.URL,
+		Upgrade: &UpgradeLimits{MaxLifetime: Duration(300 * time.Millisecond)},
+	})
+	defer proxy.Close()
+
+	conn, br := dialUpgrade(t, proxy)
+	start := time.Now()
+	// keep the connection busy, so only the lifetime can close it
+	for time.Since(start) < 2*time.Second {
+		_, err := io.WriteString(conn, "x")
+		if err != nil {
+			break
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := br.ReadByte(); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	if elapsed >= 2*time.Second {
+		t.Fatalf("connection not closed after max lifetime, open for %s", elapsed)
+	}
+	if elapsed < 250*time.Millisecond {
+		t.Fatalf("connection closed before max lifetime, after %s", elapsed)
+	}
+}
@@ -0,0 +1,61 @@
+package epoxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// UpstreamTLS configures TLS of connections to the targets of a route.
+type UpstreamTLS struct {
+	CAFile             string `json:"ca_file,omitempty"`   // PEM bundle trusted instead of the system roots
+	CertFile           string `json:"cert_file,omitempty"` // client certificate, for mutual TLS
+	KeyFile            string `json:"key_file,omitempty"`
+	ServerName         string `json:"server_name,omitempty"` // SNI and name to verify, instead of the target host
+	MinVersion         string `json:"min_version,omitempty"` // 1.0, 1.1, 1.2 (default) or 1.3
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+func (u *UpstreamTLS) config() (*tls.Config, error) {
+	c := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         u.ServerName,
+		InsecureSkipVerify: u.InsecureSkipVerify,
+	}
+	switch u.MinVersion {
+	case "":
+	case "1.0":
+		c.MinVersion = tls.VersionTLS10
+	case "1.1":
+		c.MinVersion = tls.VersionTLS11
+	case "1.2":
+		c.MinVersion = tls.VersionTLS12
+	case "1.3":
+		c.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unknown tls min_version '%s'", u.MinVersion)
+	}
+	if u.CAFile != "" {
+		b, err := os.ReadFile(u.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading tls ca_file: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in tls ca_file '%s'", u.CAFile)
+		}
+	}
+	if (u.CertFile == "") != (u.KeyFile == "") {
+		return nil, errors.New("tls cert_file and key_file must be set together")
+	}
+	if u.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(u.CertFile, u.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading tls client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
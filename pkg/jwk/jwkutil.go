@@ -2,7 +2,6 @@ package jwk
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"github.com/MicahParks/keyfunc/v3"
 	"github.com/golang-jwt/jwt/v5"
@@ -16,11 +15,15 @@ type Cache interface {
 	Get(key string) string
 }
 
-func ParseWithUrl(ctx context.Context, cache Cache, jwkUrl string, jwtToken string) (*jwt.Token, error) {
-	return ParseWithUrlIntoClaims(ctx, cache, jwkUrl, jwtToken, nil)
+func ParseWithUrl(ctx context.Context, cache Cache, jwkUrl string, jwtToken string, opts ...Option) (*jwt.Token, error) {
+	return ParseWithUrlIntoClaims(ctx, cache, jwkUrl, jwtToken, nil, opts...)
 }
 
-func ParseWithUrlIntoClaims(ctx context.Context, cache Cache, jwkUrl string, jwtToken string, claims jwt.Claims) (*jwt.Token, error) {
+// ParseWithUrlIntoClaims verifies the token with the key set of jwkUrl, cached by the hour in cache, and also parses
+// it into claims if not nil. The claims of the returned token are jwt.MapClaims.
+//
+// Deprecated: use a Provider, which keeps the key set refreshed and refetches it on unknown key ids.
+func ParseWithUrlIntoClaims(ctx context.Context, cache Cache, jwkUrl string, jwtToken string, claims jwt.Claims, opts ...Option) (*jwt.Token, error) {
 	jwkCacheKey := time.Now().Format("2006-01-02T15")
 	var jwkJson string
 	if cache != nil {
@@ -40,15 +43,12 @@ func ParseWithUrlIntoClaims(ctx context.Context, cache Cache, jwkUrl string, jwt
 	if cache != nil {
 		cache.Set(jwkCacheKey, jwkJson)
 	}
-	token, err := jwt.Parse(jwtToken, jwks.Keyfunc)
+	token, err := parse(jwtToken, nil, jwks.Keyfunc, opts)
 	if err != nil {
 		return nil, err
 	}
-	if !token.Valid {
-		return nil, errors.New("token not valid")
-	}
 	if claims != nil {
-		_, err := jwt.ParseWithClaims(jwtToken, claims, jwks.Keyfunc)
+		_, err := parse(jwtToken, claims, jwks.Keyfunc, opts)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,122 @@
+package jwk
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Option configures the validation of a token, in addition to the signature and the exp, nbf and iat claims.
+type Option func(*options)
+
+type options struct {
+	parserOptions  []jwt.ParserOption
+	requiredClaims []string
+	issuer         string
+}
+
+// WithIssuer requires the iss claim to be issuer, ignoring a trailing slash in either.
+func WithIssuer(issuer string) Option {
+	return func(o *options) {
+		o.issuer = strings.TrimSuffix(issuer, "/")
+	}
+}
+
+// WithAudience requires the aud claim to contain at least one of audiences.
+func WithAudience(audiences ...string) Option {
+	return func(o *options) {
+		o.parserOptions = append(o.parserOptions, jwt.WithAudience(audiences...))
+	}
+}
+
+// WithAlgorithms restricts the signing algorithms accepted, e.g. "ES256" or "RS256".
+func WithAlgorithms(algs ...string) Option {
+	return func(o *options) {
+		o.parserOptions = append(o.parserOptions, jwt.WithValidMethods(algs))
+	}
+}
+
+// WithLeeway allows for clock skew when validating the exp, nbf and iat claims.
+func WithLeeway(leeway time.Duration) Option {
+	return func(o *options) {
+		o.parserOptions = append(o.parserOptions, jwt.WithLeeway(leeway))
+	}
+}
+
+// WithRequiredClaims requires the claims to be present in the token, e.g. "exp" or "sub".
+func WithRequiredClaims(names ...string) Option {
+	return func(o *options) {
+		for _, name := range names {
+			if name == "exp" {
+				o.parserOptions = append(o.parserOptions, jwt.WithExpirationRequired())
+			}
+		}
+		o.requiredClaims = append(o.requiredClaims, names...)
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// parse verifies the token with keyfunc, and parses it into claims, once.
+func parse(jwtToken string, claims jwt.Claims, keyfunc jwt.Keyfunc, opts []Option) (*jwt.Token, error) {
+	o := newOptions(opts)
+	if claims == nil {
+		claims = jwt.MapClaims{}
+	}
+	token, err := jwt.NewParser(o.parserOptions...).ParseWithClaims(jwtToken, claims, keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("token not valid")
+	}
+	if len(o.requiredClaims) > 0 || o.issuer != "" {
+		err = o.verifyPayload(token.Raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
+// verifyPayload checks the issuer and the presence of required claims in the payload of a verified token, whatever
+// claims type it was parsed into.
+func (o *options) verifyPayload(raw string) error {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return jwt.ErrTokenMalformed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	var present map[string]json.RawMessage
+	err = json.Unmarshal(payload, &present)
+	if err != nil {
+		return err
+	}
+	if o.issuer != "" {
+		var iss string
+		_ = json.Unmarshal(present["iss"], &iss)
+		if strings.TrimSuffix(iss, "/") != o.issuer {
+			return fmt.Errorf("%w: %s", jwt.ErrTokenInvalidIssuer, iss)
+		}
+	}
+	for _, name := range o.requiredClaims {
+		if v, ok := present[name]; !ok || string(v) == "null" || string(v) == `""` {
+			return fmt.Errorf("%w: %s claim is required", jwt.ErrTokenRequiredClaimMissing, name)
+		}
+	}
+	return nil
+}
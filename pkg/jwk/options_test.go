@@ -0,0 +1,108 @@
+package jwk
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestWithIssuer(t *testing.T) {
+	k := newTestKey(t)
+	p, err := NewStaticProvider(KeySet{Keys: []Key{k.jwk}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		iss    any
+		issuer string
+		valid  bool
+	}{
+		{iss: "https://team.example.com", issuer: "https://team.example.com", valid: true},
+		{iss: "https://team.example.com/", issuer: "https://team.example.com", valid: true},
+		{iss: "https://team.example.com", issuer: "https://team.example.com/", valid: true},
+		{iss: "https://team.example.com/", issuer: "https://team.example.com/", valid: true},
+		{iss: "https://other.example.com", issuer: "https://team.example.com", valid: false},
+		{iss: "https://team.example.com//", issuer: "https://team.example.com", valid: false},
+		{iss: nil, issuer: "https://team.example.com", valid: false},
+		{iss: 1, issuer: "https://team.example.com", valid: false},
+	} {
+		claims := validClaims()
+		if tc.iss != nil {
+			claims["iss"] = tc.iss
+		}
+		_, err := p.Parse(k.sign(t, claims), nil, WithIssuer(tc.issuer))
+		if tc.valid && err != nil {
+			t.Errorf("iss %v, issuer %s: expected valid, got %v", tc.iss, tc.issuer, err)
+		}
+		if !tc.valid && !errors.Is(err, jwt.ErrTokenInvalidIssuer) {
+			t.Errorf("iss %v, issuer %s: expected invalid issuer, got %v", tc.iss, tc.issuer, err)
+		}
+	}
+}
+
+type subjectClaims struct {
+	jwt.RegisteredClaims
+	Email string `json:"email"`
+}
+
+func TestWithRequiredClaims(t *testing.T) {
+	k := newTestKey(t)
+	p, err := NewStaticProvider(KeySet{Keys: []Key{k.jwk}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		claims jwt.MapClaims
+		remove string
+		valid  bool
+	}{
+		{name: "present", claims: jwt.MapClaims{"email": "alice@test.com"}, valid: true},
+		{name: "missing", claims: jwt.MapClaims{}},
+		{name: "null", claims: jwt.MapClaims{"email": nil}},
+		{name: "empty", claims: jwt.MapClaims{"email": ""}},
+		{name: "missing exp", claims: jwt.MapClaims{"email": "alice@test.com"}, remove: "exp"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := validClaims()
+			for name, v := range tc.claims {
+				claims[name] = v
+			}
+			delete(claims, tc.remove)
+			raw := k.sign(t, claims)
+			// the presence is checked in the payload, whatever the claims are parsed into
+			for _, into := range []jwt.Claims{nil, &subjectClaims{}} {
+				_, err := p.Parse(raw, into, WithRequiredClaims("exp", "email"))
+				if tc.valid && err != nil {
+					t.Errorf("%T: expected valid, got %v", into, err)
+				}
+				if !tc.valid && !errors.Is(err, jwt.ErrTokenRequiredClaimMissing) {
+					t.Errorf("%T: expected missing claim, got %v", into, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWithAudienceAndLeeway(t *testing.T) {
+	k := newTestKey(t)
+	p, err := NewStaticProvider(KeySet{Keys: []Key{k.jwk}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := validClaims()
+	claims["aud"] = []string{"app", "api"}
+	claims["exp"] = time.Now().Add(-30 * time.Second).Unix()
+	raw := k.sign(t, claims)
+	if _, err := p.Parse(raw, nil, WithAudience("api"), WithLeeway(time.Minute)); err != nil {
+		t.Fatalf("expected valid within leeway, got %v", err)
+	}
+	if _, err := p.Parse(raw, nil, WithAudience("api")); !errors.Is(err, jwt.ErrTokenExpired) {
+		t.Fatalf("expected expired without leeway, got %v", err)
+	}
+	if _, err := p.Parse(raw, nil, WithAudience("other"), WithLeeway(time.Minute)); !errors.Is(err, jwt.ErrTokenInvalidAudience) {
+		t.Fatalf("expected invalid audience, got %v", err)
+	}
+}
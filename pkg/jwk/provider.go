@@ -0,0 +1,214 @@
+package jwk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultRefreshInterval = time.Hour
+	minRefreshInterval     = time.Minute
+	maxRefreshInterval     = 24 * time.Hour
+	retryInterval          = 30 * time.Second
+	unknownKidInterval     = 30 * time.Second
+	refetchTimeout         = 3 * time.Second // of refetches on the request path
+)
+
+// Provider keeps the parsed key set of a JWKS url. The set is refreshed in the background when it expires according
+// to the Cache-Control max-age of the response (default 1h), and refetched when a token is signed by an unknown kid,
+// at most every 30s. The last good set is kept when the url can't be fetched.
+type Provider struct {
+	url    string
+	client *http.Client
+
+	mu      sync.RWMutex
+	keys    keyfunc.Keyfunc
+	kids    map[string]bool
+	expires time.Time
+	lastErr error
+
+	fetchMu   sync.Mutex
+	lastFetch time.Time
+}
+
+// NewProvider fetches the key set of jwkUrl and keeps it refreshed until ctx is done. A failing initial fetch is not
+// an error, it is retried in the background and on the first token to verify.
+func NewProvider(ctx context.Context, jwkUrl string) *Provider {
+	p := &Provider{
+		url:    jwkUrl,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	_ = p.refresh(ctx)
+	go p.run(ctx)
+	return p
+}
+
+// NewStaticProvider returns a provider of a fixed key set, e.g. of keys held in process, that is never refreshed.
+func NewStaticProvider(set KeySet) (*Provider, error) {
+	raw, err := json.Marshal(set)
+	if err != nil {
+		return nil, err
+	}
+	keys, kids, err := parseKeySet(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &Provider{keys: keys, kids: kids}, nil
+}
+
+// Keyfunc returns the key for the kid of the token, suitable as jwt.Keyfunc.
+func (p *Provider) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	p.mu.RLock()
+	keys, known := p.keys, p.kids[kid]
+	p.mu.RUnlock()
+	if p.url != "" && (keys == nil || (kid != "" && !known)) {
+		ctx, cancel := context.WithTimeout(context.Background(), refetchTimeout)
+		err := p.refetch(ctx)
+		cancel()
+		p.mu.RLock()
+		keys = p.keys
+		p.mu.RUnlock()
+		if keys == nil {
+			return nil, fmt.Errorf("jwk: no key set from %s: %w", p.url, err)
+		}
+	}
+	return keys.Keyfunc(token)
+}
+
+// Parse verifies the token with the key set and opts, and parses it into claims, jwt.MapClaims if nil.
+func (p *Provider) Parse(jwtToken string, claims jwt.Claims, opts ...Option) (*jwt.Token, error) {
+	return parse(jwtToken, claims, p.Keyfunc, opts)
+}
+
+func (p *Provider) run(ctx context.Context) {
+	for {
+		p.mu.RLock()
+		wait := time.Until(p.expires)
+		if p.lastErr != nil {
+			wait = retryInterval
+		}
+		p.mu.RUnlock()
+		timer := time.NewTimer(max(wait, time.Second))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		_ = p.refresh(ctx)
+	}
+}
+
+// refetch refreshes the key set, unless it was fetched within unknownKidInterval. The check and the fetch are one
+// critical section, so concurrent requests with unknown kids wait for a single fetch instead of each fetching.
+func (p *Provider) refetch(ctx context.Context) error {
+	p.fetchMu.Lock()
+	defer p.fetchMu.Unlock()
+	if time.Since(p.lastFetch) < unknownKidInterval {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		return p.lastErr
+	}
+	return p.fetchLocked(ctx)
+}
+
+func (p *Provider) refresh(ctx context.Context) error {
+	p.fetchMu.Lock()
+	defer p.fetchMu.Unlock()
+	return p.fetchLocked(ctx)
+}
+
+// fetchLocked fetches and parses the key set, keeping the last good set on errors. p.fetchMu must be held.
+func (p *Provider) fetchLocked(ctx context.Context) error {
+	p.lastFetch = time.Now()
+
+	raw, maxAge, err := p.fetch(ctx)
+	var keys keyfunc.Keyfunc
+	var kids map[string]bool
+	if err == nil {
+		keys, kids, err = parseKeySet(raw)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastErr = err
+	if err != nil {
+		return err
+	}
+	p.keys = keys
+	p.kids = kids
+	p.expires = time.Now().Add(maxAge)
+	return nil
+}
+
+func (p *Provider) fetch(ctx context.Context) ([]byte, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("bad status: %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b, refreshInterval(resp.Header.Get("Cache-Control")), nil
+}
+
+func parseKeySet(raw []byte) (keyfunc.Keyfunc, map[string]bool, error) {
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+		} `json:"keys"`
+	}
+	err := json.Unmarshal(raw, &set)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(set.Keys) == 0 {
+		return nil, nil, errors.New("jwk: empty key set")
+	}
+	keys, err := keyfunc.NewJWKSetJSON(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	kids := make(map[string]bool, len(set.Keys))
+	for _, k := range set.Keys {
+		kids[k.Kid] = true
+	}
+	return keys, kids, nil
+}
+
+// refreshInterval returns the max-age of a Cache-Control header, clamped to [minRefreshInterval, maxRefreshInterval].
+func refreshInterval(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+		if err != nil {
+			break
+		}
+		return min(max(time.Duration(seconds)*time.Second, minRefreshInterval), maxRefreshInterval)
+	}
+	return defaultRefreshInterval
+}
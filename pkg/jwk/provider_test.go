@@ -0,0 +1,178 @@
+package jwk
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type testKey struct {
+	private *ecdsa.PrivateKey
+	jwk     Key
+}
+
+func newTestKey(t *testing.T) testKey {
+	t.Helper()
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := FromECPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{private: private, jwk: key}
+}
+
+func (k testKey) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = k.jwk.Kid
+	raw, err := token.SignedString(k.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// jwksServer serves a key set that can be replaced, counting the fetches.
+type jwksServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	set     KeySet
+	fetches atomic.Int32
+}
+
+func newJwksServer(t *testing.T, keys ...testKey) *jwksServer {
+	s := &jwksServer{}
+	s.serve(keys...)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(s.set)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) serve(keys ...testKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set = KeySet{}
+	for _, k := range keys {
+		s.set.Keys = append(s.set.Keys, k.jwk)
+	}
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Minute).Unix()}
+}
+
+func TestUnknownKidRefetch(t *testing.T) {
+	a, b := newTestKey(t), newTestKey(t)
+	server := newJwksServer(t, a)
+	p := NewProvider(t.Context(), server.URL)
+
+	if _, err := p.Parse(a.sign(t, validClaims()), nil); err != nil {
+		t.Fatal(err)
+	}
+	// as if the initial fetch was long ago, so the unknown kid may refetch
+	p.fetchMu.Lock()
+	p.lastFetch = time.Time{}
+	p.fetchMu.Unlock()
+	server.serve(a, b)
+	if _, err := p.Parse(b.sign(t, validClaims()), nil); err != nil {
+		t.Fatalf("expected the rolled key to be refetched, got %v", err)
+	}
+	if n := server.fetches.Load(); n != 2 {
+		t.Fatalf("expected initial fetch and one refetch, got %d", n)
+	}
+}
+
+func TestUnknownKidRateLimit(t *testing.T) {
+	a, unknown := newTestKey(t), newTestKey(t)
+	server := newJwksServer(t, a)
+	p := NewProvider(t.Context(), server.URL)
+	p.fetchMu.Lock()
+	p.lastFetch = time.Time{}
+	p.fetchMu.Unlock()
+
+	token := unknown.sign(t, validClaims())
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Parse(token, nil); err == nil {
+				t.Error("expected unknown kid to fail")
+			}
+		}()
+	}
+	wg.Wait()
+	if n := server.fetches.Load(); n != 2 {
+		t.Fatalf("expected initial fetch and a single refetch for concurrent unknown kids, got %d", n)
+	}
+	if _, err := p.Parse(token, nil); err == nil {
+		t.Fatal("expected unknown kid to fail")
+	}
+	if n := server.fetches.Load(); n != 2 {
+		t.Fatalf("expected no refetch within %s, got %d fetches", unknownKidInterval, n)
+	}
+}
+
+func TestKeepLastGoodKeySet(t *testing.T) {
+	a := newTestKey(t)
+	server := newJwksServer(t, a)
+	p := NewProvider(t.Context(), server.URL)
+	server.serve()
+	if err := p.refresh(t.Context()); err == nil {
+		t.Fatal("expected empty key set to fail")
+	}
+	if _, err := p.Parse(a.sign(t, validClaims()), nil); err != nil {
+		t.Fatalf("expected last good key set to be kept, got %v", err)
+	}
+}
+
+func TestStaticProvider(t *testing.T) {
+	a, unknown := newTestKey(t), newTestKey(t)
+	p, err := NewStaticProvider(KeySet{Keys: []Key{a.jwk}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Parse(a.sign(t, validClaims()), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Parse(unknown.sign(t, validClaims()), nil); err == nil {
+		t.Fatal("expected unknown kid to fail")
+	}
+}
+
+func TestRefreshInterval(t *testing.T) {
+	for cacheControl, expected := range map[string]time.Duration{
+		"":                             defaultRefreshInterval,
+		"no-cache":                     defaultRefreshInterval,
+		"max-age=600":                  10 * time.Minute,
+		"public, max-age=600":          10 * time.Minute,
+		"public,MAX-AGE=600,immutable": 10 * time.Minute,
+		`max-age="600"`:                10 * time.Minute,
+		"max-age=1":                    minRefreshInterval,
+		"max-age=0":                    minRefreshInterval,
+		"max-age=31536000":             maxRefreshInterval,
+		"max-age=abc":                  defaultRefreshInterval,
+		"s-maxage=600":                 defaultRefreshInterval,
+	} {
+		if interval := refreshInterval(cacheControl); interval != expected {
+			t.Errorf("%q: expected %s, got %s", cacheControl, expected, interval)
+		}
+	}
+}
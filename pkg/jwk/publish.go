@@ -0,0 +1,75 @@
+package jwk
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// Key is a public key in JSON Web Key format.
+type Key struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+// KeySet is a JSON Web Key Set, as served from a JWKS url.
+type KeySet struct {
+	Keys []Key `json:"keys"`
+}
+
+// FromECPublicKey converts a P-256 public key into a JWK for ES256 signatures, identified by its thumbprint.
+func FromECPublicKey(key *ecdsa.PublicKey) (Key, error) {
+	if key == nil || key.Curve != elliptic.P256() {
+		return Key{}, errors.New("jwk: P-256 public key required")
+	}
+	kid, err := Thumbprint(key)
+	if err != nil {
+		return Key{}, err
+	}
+	x, y := coordinates(key)
+	return Key{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   x,
+		Y:   y,
+		Kid: kid,
+		Use: "sig",
+		Alg: "ES256",
+	}, nil
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of a P-256 public key, suitable as key id.
+func Thumbprint(key *ecdsa.PublicKey) (string, error) {
+	if key == nil || key.Curve != elliptic.P256() {
+		return "", errors.New("jwk: P-256 public key required")
+	}
+	x, y := coordinates(key)
+	// members in lexicographic order, without whitespace, as required by RFC 7638
+	b, err := json.Marshal(struct {
+		Crv string `json:"crv"`
+		Kty string `json:"kty"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}{Crv: "P-256", Kty: "EC", X: x, Y: y})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func coordinates(key *ecdsa.PublicKey) (string, string) {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return base64.RawURLEncoding.EncodeToString(x), base64.RawURLEncoding.EncodeToString(y)
+}